@@ -1,7 +1,20 @@
 package main
 
-import "glua/parser"
+import (
+	"fmt"
+	"os"
+
+	"glua/parser"
+)
 
 func main() {
-	parser.Parse()
+	fileName := "_lua5.1-tests/literals.lua"
+	if len(os.Args) > 1 {
+		fileName = os.Args[1]
+	}
+
+	if err := parser.Parse(fileName); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,63 @@
+package parser_test
+
+import (
+	"testing"
+
+	"glua/parser"
+)
+
+// 只通过导出的API使用lexer
+func TestExportedTokenAPI(t *testing.T) {
+	l := parser.InitLexerBytes([]byte("x = 'a' $"), "x.lua")
+
+	var types []parser.TokenType
+	var values []string
+	var err *parser.Error
+	for {
+		var tok *parser.Token
+		if tok, err = l.Scan(); err != nil {
+			break
+		}
+		types = append(types, tok.Type())
+		values = append(values, tok.Value())
+	}
+
+	if len(types) != 3 || types[0] != parser.TId || types[1] != parser.TAssign || types[2] != parser.TStr {
+		t.Fatalf("got %v", types)
+	}
+	if values[0] != "x" || values[1] != "" || values[2] != "a" {
+		t.Fatalf("got %q", values)
+	}
+
+	if err.IsEOF() || err.Message() != "unknown token $" || err.Pos().Line() != 1 || err.Pos().Column() != 9 {
+		t.Fatalf("got %s", err)
+	}
+
+	if _, err = l.Scan(); err == nil || !err.IsEOF() {
+		t.Fatalf("want EOF, got %v", err)
+	}
+}
+
+// 编辑器给出的行列和偏移之间互相转换
+func TestExportedPositionAPI(t *testing.T) {
+	l := parser.InitLexerBytes([]byte("local a\n  b = 1"), "x.lua")
+	for _, err := l.Scan(); err == nil; _, err = l.Scan() {
+	}
+
+	off, err := l.PositionToOffset(2, 3)
+	if err != nil || off != 10 {
+		t.Fatalf("got %d %v", off, err)
+	}
+
+	pos, err := l.OffsetToPosition(off)
+	if err != nil || pos.Line() != 2 || pos.Column() != 3 || pos.Offset() != off {
+		t.Fatalf("got %v %v", pos, err)
+	}
+
+	if _, err := l.PositionToOffset(3, 1); err == nil || err.Message() == "" {
+		t.Fatal("want error")
+	}
+	if _, err := l.OffsetToPosition(100); err == nil || err.Message() == "" {
+		t.Fatal("want error")
+	}
+}
@@ -0,0 +1,259 @@
+package parser
+
+type Node interface {
+	Pos() Position
+	End() Position // 最后一个token之后的位置，Block为结束它的token的位置
+	setEnd(pos Position)
+}
+
+type Expr interface {
+	Node
+	exprNode()
+}
+
+type node struct {
+	pos Position
+	end Position
+}
+
+func (n *node) Pos() Position {
+	return n.pos
+}
+
+func (n *node) End() Position {
+	return n.end
+}
+
+func (n *node) setEnd(pos Position) {
+	n.end = pos
+}
+
+type expr struct {
+	node
+}
+
+func (expr) exprNode() {}
+
+type NumberExpr struct {
+	expr
+	Value float64
+	IsInt bool
+	Int   int64 // IsInt时的精确值
+}
+
+type StringExpr struct {
+	expr
+	Value string
+}
+
+type NameExpr struct {
+	expr
+	Name string
+}
+
+// (expr)，会把多返回值截断为一个
+type ParenExpr struct {
+	expr
+	Inner Expr
+}
+
+type BinOpExpr struct {
+	expr
+	Op  TokenType
+	Lhs Expr
+	Rhs Expr
+}
+
+type UnOpExpr struct {
+	expr
+	Op      TokenType
+	Operand Expr
+}
+
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+type stmt struct {
+	node
+}
+
+func (stmt) stmtNode() {}
+
+// a += 1，Op为对应的二元运算符
+type CompoundAssignStmt struct {
+	stmt
+	Op     TokenType
+	Target Expr
+	Value  Expr
+}
+
+type NilExpr struct {
+	expr
+}
+
+type BoolExpr struct {
+	expr
+	Value bool
+}
+
+// ...
+type VarargExpr struct {
+	expr
+}
+
+// local a, b = 1, 2，Values的个数不一定和Names一致
+type LocalStmt struct {
+	stmt
+	Names  []string
+	Values []Expr
+}
+
+// a, b = b, a
+type AssignStmt struct {
+	stmt
+	Targets []Expr
+	Values  []Expr
+}
+
+type Block struct {
+	node
+	Stmts []Stmt
+}
+
+type IfBranch struct {
+	Cond Expr
+	Body *Block
+}
+
+// if ... then ... elseif ... then ... else ... end
+type IfStmt struct {
+	stmt
+	Branches []*IfBranch // 第一个是if，其余是elseif
+	Else     *Block
+}
+
+type WhileStmt struct {
+	stmt
+	Cond Expr
+	Body *Block
+}
+
+// until的条件可以引用Body里声明的local，所以两者放在一起
+type RepeatStmt struct {
+	stmt
+	Body *Block
+	Cond Expr
+}
+
+// do ... end，只是引入一个新的作用域
+type DoStmt struct {
+	stmt
+	Body *Block
+}
+
+type BreakStmt struct {
+	stmt
+}
+
+// for i = 1, 10, 2 do ... end，Step可以为nil
+type ForNumStmt struct {
+	stmt
+	Var   string
+	Start Expr
+	Stop  Expr
+	Step  Expr
+	Body  *Block
+}
+
+// for k, v in pairs(t) do ... end
+type ForInStmt struct {
+	stmt
+	Names []string
+	Exprs []Expr
+	Body  *Block
+}
+
+// t.k 和 t[k]，t.k 的Key是StringExpr
+type IndexExpr struct {
+	expr
+	Obj Expr
+	Key Expr
+}
+
+// Key为nil时是数组部分的元素，x = 1 的Key是StringExpr
+type TableField struct {
+	Key   Expr
+	Value Expr
+}
+
+// {1, 2; x = 1, [k] = v}
+type TableExpr struct {
+	expr
+	Fields []*TableField
+}
+
+type FunctionExpr struct {
+	expr
+	Params   []string
+	IsVararg bool
+	Body     *Block
+
+	paramsEnd Position // 参数列表的)之后
+}
+
+// obj:m(args) 的Method为m，调用时隐式把obj作为self传入
+type FuncCallExpr struct {
+	expr
+	Fn     Expr
+	Method string
+	Args   []Expr
+}
+
+// require "mod" 和 require(expr)，require是关键字，不带括号时参数只能是字符串
+type RequireExpr struct {
+	expr
+	Module string
+	Arg    Expr // 参数不是字符串字面量时的表达式，这时Module为空
+}
+
+type RequireStmt struct {
+	stmt
+	Require *RequireExpr
+}
+
+type FuncCallStmt struct {
+	stmt
+	Call *FuncCallExpr
+}
+
+// function a.b:c() end，IsMethod时Func.Params的第一个参数是隐式的self
+type FunctionStmt struct {
+	stmt
+	Name     Expr
+	IsMethod bool
+	Func     *FunctionExpr
+}
+
+type LocalFunctionStmt struct {
+	stmt
+	Name string
+	Func *FunctionExpr
+}
+
+type GotoStmt struct {
+	stmt
+	Label string
+}
+
+// ::name::
+type LabelStmt struct {
+	stmt
+	Name string
+}
+
+type ReturnStmt struct {
+	stmt
+	Values []Expr
+}
@@ -0,0 +1,180 @@
+package parser
+
+import "math"
+
+// 超过2^53的整数转换成float64会丢失精度，为了安全这种整数不折叠
+const maxExactInt = 1 << 53
+
+// 把数字字面量之间的算术运算在编译期算出来，除零和溢出保持原样。
+// 会进入调用参数、table和索引等子表达式，但不处理函数体里的语句
+func FoldConstants(e Expr) Expr {
+	switch n := e.(type) {
+	case *ParenExpr:
+		inner := FoldConstants(n.Inner)
+		if num, ok := inner.(*NumberExpr); ok {
+			return foldedNumber(n, num.Value, num.IsInt, num.Int)
+		}
+		c := *n
+		c.Inner = inner
+		return &c
+	case *UnOpExpr:
+		operand := FoldConstants(n.Operand)
+		if num, ok := operand.(*NumberExpr); ok && n.Op == TMinus {
+			if !num.IsInt {
+				return foldedNumber(n, -num.Value, false, 0)
+			}
+			if exactInt(num.Int) {
+				return foldedNumber(n, -num.Value, true, -num.Int)
+			}
+		}
+		c := *n
+		c.Operand = operand
+		return &c
+	case *BinOpExpr:
+		lhs := FoldConstants(n.Lhs)
+		rhs := FoldConstants(n.Rhs)
+		a, ok1 := lhs.(*NumberExpr)
+		b, ok2 := rhs.(*NumberExpr)
+		if ok1 && ok2 {
+			if folded := foldArith(n, a, b); folded != nil {
+				return folded
+			}
+		}
+		c := *n
+		c.Lhs = lhs
+		c.Rhs = rhs
+		return &c
+	case *IndexExpr:
+		c := *n
+		c.Obj = FoldConstants(n.Obj)
+		c.Key = FoldConstants(n.Key)
+		return &c
+	case *FuncCallExpr:
+		c := *n
+		c.Fn = FoldConstants(n.Fn)
+		c.Args = foldList(n.Args)
+		return &c
+	case *TableExpr:
+		c := *n
+		c.Fields = make([]*TableField, len(n.Fields))
+		for i, f := range n.Fields {
+			c.Fields[i] = &TableField{Value: FoldConstants(f.Value)}
+			if f.Key != nil {
+				c.Fields[i].Key = FoldConstants(f.Key)
+			}
+		}
+		return &c
+	}
+	return e
+}
+
+func foldList(list []Expr) []Expr {
+	if list == nil {
+		return nil
+	}
+
+	folded := make([]Expr, len(list))
+	for i, e := range list {
+		folded[i] = FoldConstants(e)
+	}
+
+	return folded
+}
+
+func exactInt(n int64) bool {
+	return n >= -maxExactInt && n <= maxExactInt
+}
+
+func foldedNumber(e Expr, v float64, isInt bool, n int64) *NumberExpr {
+	return &NumberExpr{expr: expr{node{pos: e.Pos(), end: e.End()}}, Value: v, IsInt: isInt, Int: n}
+}
+
+// 不能折叠时返回nil
+func foldArith(e *BinOpExpr, a, b *NumberExpr) *NumberExpr {
+	if a.IsInt && !exactInt(a.Int) || b.IsInt && !exactInt(b.Int) {
+		return nil
+	}
+
+	// 两个整数的 + - * // % 结果还是整数
+	if a.IsInt && b.IsInt {
+		x, y := a.Int, b.Int
+		var n int64
+
+		switch e.Op {
+		case TPlus:
+			n = x + y
+		case TMinus:
+			n = x - y
+		case TStar:
+			n = x * y
+			if x != 0 && n/x != y {
+				return nil
+			}
+		case TDoubleSlash:
+			if y == 0 {
+				return nil
+			}
+			n = x / y
+			if x%y != 0 && (x < 0) != (y < 0) {
+				n--
+			}
+		case TPercent:
+			if y == 0 {
+				return nil
+			}
+			// 结果和除数同号
+			n = x % y
+			if n != 0 && (n < 0) != (y < 0) {
+				n += y
+			}
+		}
+
+		switch e.Op {
+		case TPlus, TMinus, TStar, TDoubleSlash, TPercent:
+			if !exactInt(n) {
+				return nil
+			}
+			return foldedNumber(e, float64(n), true, n)
+		}
+	}
+
+	x, y := a.Value, b.Value
+	var v float64
+
+	switch e.Op {
+	case TPlus:
+		v = x + y
+	case TMinus:
+		v = x - y
+	case TStar:
+		v = x * y
+	case TSlash:
+		if y == 0 {
+			return nil
+		}
+		v = x / y
+	case TCaret:
+		v = math.Pow(x, y)
+	case TDoubleSlash:
+		if y == 0 {
+			return nil
+		}
+		v = math.Floor(x / y)
+	case TPercent:
+		if y == 0 {
+			return nil
+		}
+		v = math.Mod(x, y)
+		if v != 0 && (v < 0) != (y < 0) {
+			v += y
+		}
+	default:
+		return nil
+	}
+
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return nil
+	}
+
+	return foldedNumber(e, v, false, 0)
+}
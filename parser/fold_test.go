@@ -0,0 +1,86 @@
+package parser
+
+import "testing"
+
+func TestFoldConstants(t *testing.T) {
+	cases := []struct {
+		src   string
+		v     float64
+		isInt bool
+	}{
+		{"1 + 2", 3, true},
+		{"2 + 3 * 4", 14, true},
+		{"2 ^ 10", 1024, false},
+		{"(2 + 3) * 4", 20, true},
+		{"7 // 2", 3, true},
+		{"-7 // 2", -4, true},
+		{"-7 % 3", 2, true},
+		{"7.5 % -2", -0.5, false},
+		{"1 / 2", 0.5, false},
+		{"1 + 2.0", 3, false},
+		{"-(3 - 5)", 2, true},
+	}
+
+	for _, c := range cases {
+		e, err := ParseExprString(c.src)
+		if err != nil {
+			t.Fatalf("%s: %s", c.src, err)
+		}
+
+		n, ok := FoldConstants(e).(*NumberExpr)
+		if !ok || n.Value != c.v || n.IsInt != c.isInt || n.IsInt && n.Int != int64(c.v) {
+			t.Fatalf("%s: got %#v", c.src, FoldConstants(e))
+		}
+		if n.Pos() != e.Pos() || n.End() != e.End() {
+			t.Fatalf("%s: position not kept", c.src)
+		}
+	}
+}
+
+func TestFoldConstantsUnfolded(t *testing.T) {
+	for _, src := range []string{
+		"1 / 0",
+		"1 // 0",
+		"1 % 0",
+		"1.5 // 0",
+		"4503599627370496 * 4",
+		"9007199254740993 - 9007199254740992",
+		"-9223372036854775807",
+		"1e308 * 10",
+		"a + 1",
+		"1 .. 2",
+		"1 == 1",
+	} {
+		e, err := ParseExprString(src)
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if _, ok := FoldConstants(e).(*NumberExpr); ok {
+			t.Errorf("%s: should not be folded", src)
+		}
+	}
+}
+
+func TestFoldConstantsNested(t *testing.T) {
+	cases := map[string]string{
+		"x * (1 + 2)":                        "x * 3",
+		"f(1 + 2, {2 * 3, [1 + 1] = 4 - 1})": "f(3, {6, [2] = 3})",
+		"t[2 ^ 1]":                           "t[2.0]",
+		"t:m(1 / 0)":                         "t:m(1 / 0)",
+	}
+
+	for src, want := range cases {
+		e, err := ParseExprString(src)
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if got := Print(FoldConstants(e)); got != want {
+			t.Errorf("%s: got %s, want %s", src, got, want)
+		}
+		if got := Print(e); got != src {
+			t.Errorf("%s: original changed to %s", src, got)
+		}
+	}
+}
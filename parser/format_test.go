@@ -0,0 +1,90 @@
+package parser
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testdata/format下每个.lua格式化之后要和同名的.golden一致
+func TestFormatGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/format/*.lua")
+	if err != nil || len(files) == 0 {
+		t.Fatal("no golden inputs", err)
+	}
+
+	for _, f := range files {
+		src, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, perr := Format(string(src), f)
+		if perr != nil {
+			t.Errorf("%s: %s", f, perr)
+			continue
+		}
+
+		golden := strings.TrimSuffix(f, ".lua") + ".golden"
+		if *update {
+			if err := os.WriteFile(golden, []byte(out), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != string(want) {
+			t.Errorf("%s: got\n%s", f, out)
+		}
+
+		// 格式化的结果再格式化一次不变
+		if again, perr := Format(out, f); perr != nil || again != out {
+			t.Errorf("%s: not stable: %v\n%s", f, perr, again)
+		}
+	}
+}
+
+func countComments(src string) int {
+	l := lex(src)
+	scanAll(l)
+	return len(l.Comments())
+}
+
+// 格式化不会丢掉注释，结果再格式化一次不变
+func TestFormatLuaFiles(t *testing.T) {
+	files, err := filepath.Glob("../_lua5.1-tests/*.lua")
+	if err != nil || len(files) == 0 {
+		t.Fatal("no test files", err)
+	}
+
+	for _, f := range files {
+		if _, ok := unparsableFiles[filepath.Base(f)]; ok {
+			continue
+		}
+
+		src, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, perr := Format(string(src), f)
+		if perr != nil {
+			t.Errorf("%s: %s", f, perr)
+			continue
+		}
+
+		if a, b := countComments(string(src)), countComments(out); a != b {
+			t.Errorf("%s: %d comments before formatting, %d after", f, a, b)
+		}
+		if again, perr := Format(out, f); perr != nil || again != out {
+			t.Errorf("%s: not stable: %v", f, perr)
+		}
+	}
+}
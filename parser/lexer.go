@@ -2,18 +2,21 @@ package parser
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
 	"strings"
-	"unicode"
+	"unicode/utf8"
 )
 
-type tokenType int
+type TokenType int
 
 const EOF = -1
 
 const (
-	TAnd tokenType = iota
+	TAnd TokenType = iota
 	TBreak
 	TDo
 	TElse
@@ -36,35 +39,53 @@ const (
 	TTrue
 	TUntil
 	TWhile
-	TId          tokenType = 1<<8 + iota
-	TAssign                // =
-	TEq                    // ==
-	TNe                    // ~=
-	TGt                    // >
-	TLt                    // <
-	TGte                   // >=
-	TLte                   // <=
-	TMinus                 // -
-	TMinusAssign           // -=
-	TPlus                  // +
-	TPlusAssign            // +=
+	keywordEnd // 以上是关键字
+
+	TId
 	TNumber
 	TStr
+
+	TAssign       // =
+	TEq           // ==
+	TNe           // ~=
+	TGt           // >
+	TLt           // <
+	TGte          // >=
+	TLte          // <=
+	TMinus        // -
+	TMinusAssign  // -=
+	TPlus         // +
+	TPlusAssign   // +=
 	TLeftParent   // (
 	TRightParent  // )
 	TComma        // ,
 	TDot          // .
-	T2Dot         // .
+	T2Dot         // ..
+	T3Dot         // ...
+	TConcatAssign // ..=
 	TColon        // :
+	TDoubleColon  // ::
+	TSemicolon    // ;
 	TOpenBrace    // {
 	TCloseBrace   // }
 	TLeftBracket  // [
 	TRightBracket // ]
 	TPound        // #
+	TStar         // *
+	TSlash        // /
+	TPercent      // %
+	TCaret        // ^
+	TAmp          // &
+	TPipe         // |
+	TBXor         // ~
+	TShl          // <<
+	TShr          // >>
+	TDoubleSlash  // //
+	operatorEnd   // 从TAssign到这里是运算符和标点
 )
 
 var (
-	keywordsStr2Token, tokenName = map[string]tokenType{
+	keywordsStr2Token, tokenName = map[string]TokenType{
 		"and":      TAnd,
 		"break":    TBreak,
 		"do":       TDo,
@@ -88,65 +109,375 @@ var (
 		"true":     TTrue,
 		"until":    TUntil,
 		"while":    TWhile,
-	}, map[tokenType]string{
-		TId:           "id",
-		TAssign:       "assign",      // =
-		TEq:           "eq",          // ==
-		TNe:           "ne",          // ~=
-		TGt:           "gt",          // >
-		TLt:           "lt",          // <
-		TGte:          "gte",         // >=
-		TLte:          "lte",         // <=
-		TMinus:        "minus",       // -
-		TMinusAssign:  "minusAssign", // -=
-		TPlus:         "plus",        // +
-		TPlusAssign:   "plusAssign",  // +
-		TNumber:       "number",
-		TStr:          "str",
-		TLeftParent:   "leftParenthesis",  // (
-		TRightParent:  "rightParenthesis", // )
-		TComma:        "comma",            // ,
-		TDot:          "dot",              // .
-		T2Dot:         "2Dot",             // ..
-		TColon:        "colon",            // :
-		TOpenBrace:    "openBrace",        // {
-		TCloseBrace:   "closeBrace",       // }
-		TLeftBracket:  "leftBracket",      // [
-		TRightBracket: "rightBracket",     // ]
-		TPound:        "pound",            // #
+	}, map[TokenType]string{
+		TId:           "<name>",
+		TAssign:       "=",
+		TEq:           "==",
+		TNe:           "~=",
+		TGt:           ">",
+		TLt:           "<",
+		TGte:          ">=",
+		TLte:          "<=",
+		TMinus:        "-",
+		TMinusAssign:  "-=",
+		TPlus:         "+",
+		TPlusAssign:   "+=",
+		TNumber:       "<number>",
+		TStr:          "<string>",
+		TLeftParent:   "(",
+		TRightParent:  ")",
+		TComma:        ",",
+		TDot:          ".",
+		T2Dot:         "..",
+		T3Dot:         "...",
+		TConcatAssign: "..=",
+		TColon:        ":",
+		TDoubleColon:  "::",
+		TSemicolon:    ";",
+		TOpenBrace:    "{",
+		TCloseBrace:   "}",
+		TLeftBracket:  "[",
+		TRightBracket: "]",
+		TPound:        "#",
+		TStar:         "*",
+		TSlash:        "/",
+		TPercent:      "%",
+		TCaret:        "^",
+		TAmp:          "&",
+		TPipe:         "|",
+		TBXor:         "~",
+		TShl:          "<<",
+		TShr:          ">>",
+		TDoubleSlash:  "//",
 	}
+	keywordsToken2Str = func() map[TokenType]string {
+		m := make(map[TokenType]string, len(keywordsStr2Token))
+		for k, v := range keywordsStr2Token {
+			m[v] = k
+		}
+		return m
+	}()
 )
 
 type Error struct {
 	pos Position
 	msg string
+	eof bool // 是否因为读到文件末尾
 }
 
 type Position struct {
 	line     int
 	column   int
+	offset   int // 距离文件开头的字节数
 	fileName string
 }
 
 type Token struct {
-	pos Position
-	typ tokenType
-	val string
+	pos   Position
+	end   Position // token结束后的下一个位置
+	typ   TokenType
+	val   string
+	num   float64 // TNumber的值
+	isInt bool
+	ival  int64  // 整数的精确值，float64放不下2^53以上的整数
+	quote byte   // TStr的引号，' " 或者长字符串的[
+	level int    // 长字符串[==[中=的个数
+	raw   string // TNumber在源码中的原文，包括_
+}
+
+// 缓冲的扫描结果，prev/current是消费它之前的状态，Rewind时恢复
+type scanned struct {
+	tok           *Token
+	err           *Error
+	prev, current *Token
+}
+
+type Comment struct {
+	pos  Position
+	end  Position
+	text string // 包括开头的--
 }
 
 type Lexer struct {
 	pos          Position
-	src          *bufio.Reader
+	src          []byte // 全部源码，pos.offset就是下一个要读的字节
 	prevToken    *Token
 	currentToken *Token
+	buffer       []scanned // 预读或者Mark之后扫描出的token
+	cursor       int       // 下一个要返回的buffer下标
+	marks        []int     // 还没有Release的mark，不为空时buffer不回收，保证能Rewind
+	lineStarts   []int     // 每一行第一个字节的offset
+	resilient    bool      // 容错模式，遇到错误时记录下来并继续扫描
+	maxTokenLen  int       // token的最大字节数，0表示不限制
+	normalizeNum bool      // 数字的val统一成小写
+	errors       []*Error
+	comments     []Comment
+	buf          []byte // 扫描字符串、数字和名字时复用，每个token开始时清空
+	readErr      *Error // Reset读取src时的错误，第一次扫描时返回
+}
+
+func (p Position) Line() int {
+	return p.line
+}
+
+func (p Position) Column() int {
+	return p.column
+}
+
+func (p Position) Offset() int {
+	return p.offset
+}
+
+func (t Token) Type() TokenType {
+	return t.typ
+}
+
+// 名字和字符串的内容或者数字的文本，关键字和运算符为空
+func (t Token) Value() string {
+	return t.val
+}
+
+func (t Token) Pos() Position {
+	return t.pos
+}
+
+func (t Token) End() Position {
+	return t.end
+}
+
+// 返回数字的值以及是否为整数
+func (t Token) Number() (float64, bool) {
+	return t.num, t.isInt
+}
+
+// 整数token的精确值，不是整数时为0
+func (t Token) Int() int64 {
+	return t.ival
+}
+
+// 字符串token来自哪种引号，长字符串返回'['，其他token返回0
+func (t Token) Quote() byte {
+	return t.quote
+}
+
+// 数字的原文，其他token就是值本身
+func (t Token) Raw() string {
+	if t.typ == TNumber {
+		return t.raw
+	}
+
+	return t.val
+}
+
+// 长字符串的层级，[[ 是0，[==[ 是2
+func (t Token) Level() int {
+	return t.level
+}
+
+// 格式为 TYPE("val")@line:col，没有值的token省略括号部分
+func (t Token) String() string {
+	if t.val == "" && t.typ != TStr {
+		return fmt.Sprintf("%s@%d:%d", t.typ, t.pos.line, t.pos.column)
+	}
+
+	return fmt.Sprintf("%s(%q)@%d:%d", t.typ, t.val, t.pos.line, t.pos.column)
+}
+
+func (c Comment) Pos() Position {
+	return c.pos
+}
+
+func (c Comment) End() Position {
+	return c.end
+}
+
+func (c Comment) Text() string {
+	return c.text
+}
+
+// 已经扫描过的注释
+func (l *Lexer) Comments() []Comment {
+	return l.comments
+}
+
+func (e *Error) Pos() Position {
+	return e.pos
+}
+
+func (e *Error) Message() string {
+	return e.msg
+}
+
+// Scan读到文件末尾时返回的错误，不是真正的错误
+func (e *Error) IsEOF() bool {
+	return e.eof
 }
 
 func (e *Error) String() string {
 	return fmt.Sprintf("file: %s line: %d(column: %d) %s", e.pos.fileName, e.pos.line, e.pos.column, e.msg)
 }
 
+// 开启后Scan遇到错误会记录下来并跳过，可以通过Errors取出
+func (l *Lexer) SetResilient(resilient bool) {
+	l.resilient = resilient
+}
+
+// 开启后数字token的val统一成小写，比如0XFF变成0xff、1E5变成1e5，原文可以通过Token.Raw取得
+func (l *Lexer) SetNormalizeNumbers(normalize bool) {
+	l.normalizeNum = normalize
+}
+
+// 限制单个token的字节数，超过时报token too long，防止没闭合的长字符串把整个文件读进去，0表示不限制
+func (l *Lexer) SetMaxTokenLength(n int) {
+	l.maxTokenLen = n
+}
+
+// start是token的开始位置
+func (l *Lexer) checkTokenLength(start Position) *Error {
+	if l.maxTokenLen > 0 && l.pos.offset-start.offset > l.maxTokenLen {
+		return &Error{pos: start, msg: "token too long"}
+	}
+
+	return nil
+}
+
+// 返回到目前为止记录的所有错误，扫描过程中可以随时调用
+func (l *Lexer) Errors() []*Error {
+	return append([]*Error(nil), l.errors...)
+}
+
+func (l *Lexer) PeekToken() (*Token, *Error) {
+	l.fill(1)
+	s := l.buffer[l.cursor]
+	return s.tok, s.err
+}
+
+// 预读n个token但不消费，到EOF时返回的个数可能少于n，遇到错误时返回错误之前的token。
+// n <= 0时什么都不读，返回nil
+func (l *Lexer) LookaheadN(n int) ([]Token, *Error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	l.fill(n)
+
+	tokens := make([]Token, 0, n)
+	for _, s := range l.buffer[l.cursor:] {
+		if len(tokens) == n || s.err != nil && s.err.eof {
+			break
+		}
+		if s.err != nil {
+			return tokens, s.err
+		}
+		tokens = append(tokens, *s.tok)
+	}
+
+	return tokens, nil
+}
+
 func (l *Lexer) Scan() (*Token, *Error) {
-	l.prevToken = l.currentToken
+	l.fill(1)
+	s := &l.buffer[l.cursor]
+	s.prev, s.current = l.prevToken, l.currentToken
+
+	if s.err == nil || !s.err.eof {
+		l.cursor++ // 停在EOF上，之后的Scan都返回EOF
+	}
+
+	if s.err == nil {
+		l.prevToken, l.currentToken = l.currentToken, s.tok
+	}
+
+	tok, err := s.tok, s.err
+	if len(l.marks) == 0 && l.cursor == len(l.buffer) {
+		l.buffer, l.cursor = l.buffer[:0], 0
+	}
+
+	return tok, err
+}
+
+// 最后消费的token之前的那个token，预读不会影响它
+func (l *Lexer) PrevToken() *Token {
+	return l.prevToken
+}
+
+// 记录当前位置，之后可以用Rewind回到这里重新扫描，用于需要回溯的解析。
+// 不再需要回溯时要调用Release，否则buffer会一直保留之后扫描的所有token
+func (l *Lexer) Mark() int {
+	l.marks = append(l.marks, l.cursor)
+	return l.cursor
+}
+
+// 回到Mark返回的位置，之后的Scan会按原样重放buffer里的token，不是Mark返回的值会被忽略。
+// Rewind之后mark仍然有效，可以再次Rewind
+func (l *Lexer) Rewind(mark int) {
+	if !l.hasMark(mark) || mark > l.cursor {
+		return
+	}
+
+	if mark < l.cursor {
+		s := l.buffer[mark]
+		l.prevToken, l.currentToken = s.prev, s.current
+	}
+	l.cursor = mark
+}
+
+// 放弃Mark返回的位置，所有mark都释放后已经消费的token会被回收
+func (l *Lexer) Release(mark int) {
+	for i := len(l.marks) - 1; i >= 0; i-- {
+		if l.marks[i] == mark {
+			l.marks = append(l.marks[:i], l.marks[i+1:]...)
+			break
+		}
+	}
+
+	if len(l.marks) == 0 {
+		n := copy(l.buffer, l.buffer[l.cursor:])
+		l.buffer, l.cursor = l.buffer[:n], 0
+	}
+}
+
+func (l *Lexer) hasMark(mark int) bool {
+	for _, m := range l.marks {
+		if m == mark {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 保证buffer里至少有n个未消费的结果，遇到EOF就停止
+func (l *Lexer) fill(n int) {
+	if l.readErr != nil {
+		l.buffer = append(l.buffer, scanned{err: l.readErr})
+		l.readErr = nil
+	}
+
+	for len(l.buffer)-l.cursor < n {
+		if k := len(l.buffer); k > 0 && l.buffer[k-1].err != nil && l.buffer[k-1].err.eof {
+			return
+		}
+
+		current := l.currentToken
+		tok, err := l.scanSkippingErrors()
+		l.currentToken = current
+		l.buffer = append(l.buffer, scanned{tok: tok, err: err})
+	}
+}
+
+func (l *Lexer) scanSkippingErrors() (*Token, *Error) {
+	for {
+		t, err := l.scan()
+		if err == nil || err.eof || !l.resilient {
+			return t, err
+		}
+
+		l.errors = append(l.errors, err)
+	}
+}
+
+func (l *Lexer) scan() (*Token, *Error) {
 retry:
 	c := l.readNext()
 
@@ -154,7 +485,9 @@ retry:
 	case '-':
 		if l.peek() == '-' {
 			l.readNext()
-			l.skipComment(c)
+			if err := l.skipComment(c); err != nil {
+				return nil, err
+			}
 			goto retry
 		} else if l.peek() == '=' {
 			l.readNext()
@@ -170,14 +503,20 @@ retry:
 			l.currentToken = l.makeToken(TAssign, "", 1)
 		}
 	case '>':
-		if l.peek() == '=' {
+		if l.peek() == '>' {
+			l.readNext()
+			l.currentToken = l.makeToken(TShr, "", 2)
+		} else if l.peek() == '=' {
 			l.readNext()
 			l.currentToken = l.makeToken(TGte, "", 2)
 		} else {
 			l.currentToken = l.makeToken(TGt, "", 1)
 		}
 	case '<':
-		if l.peek() == '=' {
+		if l.peek() == '<' {
+			l.readNext()
+			l.currentToken = l.makeToken(TShl, "", 2)
+		} else if l.peek() == '=' {
 			l.readNext()
 			l.currentToken = l.makeToken(TLte, "", 2)
 		} else {
@@ -199,16 +538,33 @@ retry:
 	case '\'':
 		fallthrough
 	case '"':
-		l.matchString(c)
+		return l.matchString(c)
 	case '.':
-		if l.peek() == '.' {
+		if isDigit(l.peek()) {
+			return l.matchNumber(c)
+		} else if l.peek() == '.' {
 			l.readNext()
-			l.currentToken = l.makeToken(T2Dot, "", 2)
+			if l.peek() == '.' {
+				l.readNext()
+				l.currentToken = l.makeToken(T3Dot, "", 3)
+			} else if l.peek() == '=' {
+				l.readNext()
+				l.currentToken = l.makeToken(TConcatAssign, "", 3)
+			} else {
+				l.currentToken = l.makeToken(T2Dot, "", 2)
+			}
 		} else {
 			l.currentToken = l.makeToken(TDot, "", 1)
 		}
 	case ':':
-		l.currentToken = l.makeToken(TColon, "", 1)
+		if l.peek() == ':' {
+			l.readNext()
+			l.currentToken = l.makeToken(TDoubleColon, "", 2)
+		} else {
+			l.currentToken = l.makeToken(TColon, "", 1)
+		}
+	case ';':
+		l.currentToken = l.makeToken(TSemicolon, "", 1)
 	case '{':
 		l.currentToken = l.makeToken(TOpenBrace, "", 1)
 	case '}':
@@ -223,24 +579,43 @@ retry:
 		l.currentToken = l.makeToken(TRightBracket, "", 1)
 	case '#':
 		l.currentToken = l.makeToken(TPound, "", 1)
+	case '*':
+		l.currentToken = l.makeToken(TStar, "", 1)
+	case '/':
+		if l.peek() == '/' {
+			l.readNext()
+			l.currentToken = l.makeToken(TDoubleSlash, "", 2)
+		} else {
+			l.currentToken = l.makeToken(TSlash, "", 1)
+		}
+	case '%':
+		l.currentToken = l.makeToken(TPercent, "", 1)
+	case '^':
+		l.currentToken = l.makeToken(TCaret, "", 1)
 	case '~':
-		if l.peek() != '=' {
-			goto err
+		if l.peek() == '=' {
+			l.readNext()
+			l.currentToken = l.makeToken(TNe, "", 2)
+		} else {
+			l.currentToken = l.makeToken(TBXor, "", 1)
 		}
-		l.currentToken = l.makeToken(TNe, "", 2)
-	case '\n':
-		l.newLine()
+	case '&':
+		l.currentToken = l.makeToken(TAmp, "", 1)
+	case '|':
+		l.currentToken = l.makeToken(TPipe, "", 1)
+	case '\n', '\r':
+		l.checkNewLine(c)
 		fallthrough
-	case ' ', '\t', '\r':
+	case ' ', '\t':
 		goto retry
 	case EOF:
 		goto eof
 	default:
 		switch {
-		case unicode.IsLetter(rune(c)) || c == '_':
-			l.keywordOrId(c)
-		case unicode.IsNumber(rune(c)):
-			l.matchNumber(c)
+		case isLetter(c):
+			return l.keywordOrId(c)
+		case isDigit(c):
+			return l.matchNumber(c)
 		default:
 			goto err
 		}
@@ -252,102 +627,202 @@ eof:
 		pos: Position{
 			line:     l.pos.line,
 			column:   l.pos.column - 1,
+			offset:   l.pos.offset - 1,
 			fileName: l.pos.fileName,
 		},
 		msg: "reach end",
+		eof: true,
 	}
 err:
+	pos := Position{
+		line:     l.pos.line,
+		column:   l.pos.column - 1,
+		offset:   l.pos.offset - 1,
+		fileName: l.pos.fileName,
+	}
+
+	if c < utf8.RuneSelf {
+		return nil, &Error{pos: pos, msg: "unknown token " + string(rune(c))}
+	}
+
+	// 非ASCII字符把整个UTF-8序列读完，报告完整的字符和码点
+	b := []byte{byte(c)}
+	for len(b) < utf8.UTFMax && !utf8.FullRune(b) && l.peek() != EOF && !utf8.RuneStart(byte(l.peek())) {
+		b = append(b, byte(l.readNext()))
+	}
+
+	r, _ := utf8.DecodeRune(b)
 	return nil, &Error{
-		pos: Position{
-			line:     l.pos.line,
-			column:   l.pos.column - 1,
-			fileName: l.pos.fileName,
-		},
-		msg: "unknown token " + string(c),
+		pos: pos,
+		msg: fmt.Sprintf("unknown token '%c' (U+%04X)", r, r),
 	}
 }
 
-func (l *Lexer) skipComment(first int) {
-	var c int
+func ScanAll(src, fileName string) ([]Token, []*Error) {
+	l := InitLexerBytes([]byte(src), fileName)
+	l.SetResilient(true)
 
-	if l.peek() == '[' {
-		// 找到第二个[
-		c = l.readNext()
-		openTag := string(c)
-		str := ""
-		var c int
-
-		for c = l.peek(); c == '='; c = l.peek() {
-			l.readNext()
-			openTag += string('=')
+	var tokens []Token
+	for {
+		t, err := l.Scan()
+		if err != nil {
+			break
 		}
+		tokens = append(tokens, *t)
+	}
 
-		if c != '[' {
-			goto common
+	return tokens, l.errors
+}
+
+// 返回覆盖第line行的token，跨行的长字符串在它占的每一行都会出现
+func TokensOnLine(tokens []Token, line int) []Token {
+	var on []Token
+	for _, t := range tokens {
+		if t.pos.line <= line && line <= t.end.line {
+			on = append(on, t)
 		}
+	}
 
-		openTag += string('[')                            // [=*[
-		closeTag := strings.ReplaceAll(openTag, "[", "]") // ]=*]
+	return on
+}
 
-		// 寻找close ]=]==]
-		for c = l.peek(); c != EOF && !strings.Contains(str, closeTag); c = l.peek() {
+// 注释的文本直接从源码截取，长注释结束后同一行剩下的内容照常扫描
+func (l *Lexer) skipComment(first int) *Error {
+	start := l.pos
+	start.column -= 2
+	start.offset -= 2
+
+	long, err := l.skipLongComment()
+	if err != nil {
+		return err
+	}
+
+	if !long {
+		// 跳过所有字符，直到换行符，换行符留给scan处理
+		for c := l.peek(); c != EOF && c != '\n' && c != '\r'; c = l.peek() {
 			l.readNext()
-			if c == '\n' {
-				l.newLine()
-			}
-			str += string(c)
 		}
 	}
-common:
-	for c = l.readNext(); c != EOF && c != '\n'; c = l.readNext() {
-		// 跳过所有字符，直到换行符
+
+	text := string(l.src[start.offset:l.pos.offset])
+	l.comments = append(l.comments, Comment{pos: start, end: l.pos, text: text})
+	return nil
+}
+
+// --后面是[=*[时跳过整个长注释，否则什么都不读，没有结束的]=*]时报告在开头的[上
+func (l *Lexer) skipLongComment() (bool, *Error) {
+	rest := l.src[l.pos.offset:]
+	if len(rest) == 0 || rest[0] != '[' {
+		return false, nil
 	}
 
-	if c == '\n' {
-		l.newLine()
+	level := 1
+	for level < len(rest) && rest[level] == '=' {
+		level++
+	}
+
+	if level == len(rest) || rest[level] != '[' {
+		return false, nil
 	}
+
+	open := l.pos
+	for i := 0; i <= level; i++ {
+		l.readNext()
+	}
+
+	// 寻找close ]=]==]，每个换行都要更新行号
+	closeTag := []byte("]" + strings.Repeat("=", level-1) + "]")
+	for c := l.peek(); c != EOF && !bytes.HasSuffix(l.src[:l.pos.offset], closeTag); c = l.peek() {
+		l.readNext()
+		l.checkNewLine(c)
+	}
+
+	if !bytes.HasSuffix(l.src[:l.pos.offset], closeTag) {
+		return true, &Error{
+			pos: open,
+			msg: "unterminated long comment",
+		}
+	}
+
+	return true, nil
 }
 
 func (l *Lexer) matchString(first int) (*Token, *Error) {
+	start := l.pos
+	start.column--
+	start.offset--
+
 	if first == '\'' || first == '"' {
 		escape := false
-		str := ""
+		l.buf = l.buf[:0]
 
 		// 找到下一个同类字符
 		for c := l.readNext(); c != EOF; c = l.readNext() {
+			if err := l.checkTokenLength(start); err != nil {
+				return nil, err
+			}
+
 			if escape {
 				escape = false
 
+				// \ddd，最多三位十进制数字
+				if isDigit(c) {
+					pos := Position{
+						line:     l.pos.line,
+						column:   l.pos.column - 1,
+						offset:   l.pos.offset - 1,
+						fileName: l.pos.fileName,
+					}
+
+					n := c - '0'
+					for i := 1; i < 3 && isDigit(l.peek()); i++ {
+						n = n*10 + l.readNext() - '0'
+					}
+
+					if n > 255 {
+						return nil, &Error{
+							pos: pos,
+							msg: "decimal escape too large",
+						}
+					}
+
+					l.buf = append(l.buf, byte(n))
+					continue
+				}
+
 				switch c {
 				case '\\':
-					str += "\\"
+					l.buf = append(l.buf, '\\')
 				case 'a':
-					str += "\a"
+					l.buf = append(l.buf, '\a')
 				case 'b':
-					str += "\b"
+					l.buf = append(l.buf, '\b')
 				case 'f':
-					str += "\f"
+					l.buf = append(l.buf, '\f')
 				case 'n':
-					str += "\n"
+					l.buf = append(l.buf, '\n')
 				case 'r':
-					str += "\r"
+					l.buf = append(l.buf, '\r')
 				case 't':
-					str += "\t"
+					l.buf = append(l.buf, '\t')
 				case 'v':
-					str += "\v"
-				case '0':
-					str += "\x00"
-				case c:
-					str += string(c)
-				case '\n':
-					str += "\n"
-					l.newLine()
+					l.buf = append(l.buf, '\v')
+				case '"', '\'':
+					l.buf = append(l.buf, byte(c))
+				case '\n', '\r':
+					// \后面直接换行，\r\n只算一个换行
+					l.buf = append(l.buf, '\n')
+					l.checkNewLine(c)
+					if c == '\r' && l.peek() == '\n' {
+						l.checkNewLine(l.readNext())
+					}
 				default:
 					return nil, &Error{
 						pos: Position{
-							l.pos.line,
-							l.pos.column - 1,
-							l.pos.fileName,
+							line:     l.pos.line,
+							column:   l.pos.column - 1,
+							offset:   l.pos.offset - 1,
+							fileName: l.pos.fileName,
 						},
 						msg: "invalid escape sequence",
 					}
@@ -359,21 +834,31 @@ func (l *Lexer) matchString(first int) (*Token, *Error) {
 			if c == '\\' {
 				escape = true
 			} else if c == first {
-				l.currentToken = l.makeToken(TStr, str, 0) // 跨行token位置以结束位置为准，不然不好算
-				break
-			} else if c == '\n' {
+				l.currentToken = l.makeToken(TStr, string(l.buf), 0)
+				l.currentToken.pos = start
+				l.currentToken.quote = byte(first)
+				return l.currentToken, nil
+			} else if c == '\n' || c == '\r' {
+				// 字符串不能跨行，换行已经读掉了，先更新行号，容错模式下后面的位置才是对的
+				l.checkNewLine(c)
 				return nil, &Error{
-					pos: l.pos,
-					msg: "字符串不能跨行",
+					pos: start,
+					msg: "unterminated string literal",
 				}
 			} else {
-				str += string(c)
+				l.buf = append(l.buf, byte(c))
 			}
 		}
+
+		// 没找到结束的引号就到了文件末尾
+		return nil, &Error{
+			pos: start,
+			msg: "unterminated string literal",
+		}
 	} else { // [[ ]]  [===[ ]===]
 		// 找到第二个[
-		openTag := string(first)
-		str := ""
+		openTag := string(rune(first))
+		l.buf = l.buf[:0]
 		var c int
 
 		for c = l.readNext(); c == '='; c = l.readNext() {
@@ -391,100 +876,365 @@ func (l *Lexer) matchString(first int) (*Token, *Error) {
 		closeTag := strings.ReplaceAll(openTag, "[", "]") // ]=*]
 
 		// 如果后面紧跟一个换行，忽略这个换行符
-		if l.peek() == '\n' {
+		if c = l.peek(); c == '\n' || c == '\r' {
 			l.readNext()
+			if c == '\r' && l.peek() == '\n' {
+				l.readNext()
+			}
 			l.newLine()
 		}
 
 		// 寻找close ]=]==]
-		for c = l.peek(); c != EOF && !strings.Contains(str, closeTag); c = l.peek() {
+		for c = l.peek(); c != EOF && !bytes.HasSuffix(l.buf, []byte(closeTag)); c = l.peek() {
 			l.readNext()
-			if c == '\n' {
-				l.newLine()
+			l.checkNewLine(c)
+			l.buf = append(l.buf, byte(c))
+
+			if err := l.checkTokenLength(start); err != nil {
+				return nil, err
 			}
-			str += string(c)
 		}
 
-		if !strings.Contains(str, closeTag) {
+		if !bytes.HasSuffix(l.buf, []byte(closeTag)) {
 			return nil, &Error{
-				pos: l.pos,
-				msg: "reach end",
+				pos: start,
+				msg: "unterminated long string",
 			}
 		}
 
-		str = strings.TrimSuffix(str, closeTag)
+		str := string(l.buf[:len(l.buf)-len(closeTag)])
 		l.currentToken = l.makeToken(TStr, str, 0)
+		l.currentToken.pos = start // 跨行token以开始位置为准
+		l.currentToken.quote = '['
+		l.currentToken.level = len(openTag) - 2
 	}
 
 	return l.currentToken, nil
 }
 
-func (l *Lexer) matchNumber(first int) {
-	str := string(first)
+// 和官方lua不同，数字后面紧跟..时不会当成小数点，1..2扫描成1 .. 2，
+// 而不是报malformed number；1. .2 则是两个数字1.和.2
+func (l *Lexer) matchNumber(first int) (*Token, *Error) {
+	start := l.pos
+	start.column--
+	start.offset--
+	l.buf = append(l.buf[:0], byte(first))
+	hex := first == '0' && (l.peek() == 'x' || l.peek() == 'X')
+	dot, exp := first == '.', false
+	underscores := 0 // 分隔用的_不进val，但算在token长度里
 
-	for c := l.peek(); unicode.IsNumber(rune(c)); c = l.peek() {
-		l.readNext()
-		str += string(c)
+	if hex {
+		l.buf = append(l.buf, byte(l.readNext()))
+	}
+
+	isNumDigit := func(c int) bool {
+		return isDigit(c) || hex && isHexDigit(c)
+	}
+
+loop:
+	for c := l.peek(); ; c = l.peek() {
+		if err := l.checkTokenLength(start); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case isNumDigit(c):
+		case c == '_': // 1_000，_两边都必须是数字
+			if !isNumDigit(int(l.buf[len(l.buf)-1])) || !isNumDigit(l.peek2()) {
+				return nil, &Error{
+					pos: l.pos,
+					msg: "malformed number near '_'",
+				}
+			}
+			l.readNext()
+			underscores++
+			continue
+		case c == '.' && l.peek2() != '.': // 1..2 是 1 .. 2
+			if dot || exp {
+				// 1.2.3 和 1e2.3，错误指向多出来的小数点
+				return nil, &Error{
+					pos: l.pos,
+					msg: "malformed number " + string(l.buf) + ".",
+				}
+			}
+			dot = true
+		case (c == 'e' || c == 'E') && !hex && !exp,
+			(c == 'p' || c == 'P') && hex && !exp: // 0x1.8p1，p后面是十进制的2的指数
+			exp = true
+			l.buf = append(l.buf, byte(l.readNext()))
+			if c = l.peek(); c != '+' && c != '-' {
+				continue
+			}
+		default:
+			break loop
+		}
+		l.buf = append(l.buf, byte(l.readNext()))
+	}
+
+	str := string(l.buf)
+	t := l.makeToken(TNumber, str, len(str)+underscores)
+
+	var err error
+	switch {
+	case hex && (dot || exp):
+		if !exp {
+			str += "p0" // ParseFloat要求十六进制小数必须带指数
+		}
+		t.num, err = strconv.ParseFloat(str, 64)
+		str = t.val
+	case hex:
+		var n uint64
+		n, err = strconv.ParseUint(str[2:], 16, 64)
+		t.ival, t.isInt = int64(n), true
+		t.num = float64(t.ival)
+	case !dot && !exp:
+		if t.ival, err = strconv.ParseInt(str, 10, 64); err == nil {
+			t.num, t.isInt = float64(t.ival), true
+			break
+		}
+		t.ival = 0
+		// 超出整数范围的按浮点数处理
+		t.num, err = strconv.ParseFloat(str, 64)
+	default:
+		t.num, err = strconv.ParseFloat(str, 64)
+	}
+
+	// 和lua一样，1e999是inf，1e-999是0
+	if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange && !t.isInt {
+		err = nil
 	}
 
-	l.currentToken = l.makeToken(TStr, str, len(str))
+	if err != nil {
+		return nil, &Error{
+			pos: t.pos,
+			msg: "malformed number " + str,
+		}
+	}
+
+	t.raw = string(l.src[start.offset:l.pos.offset])
+	if l.normalizeNum {
+		t.val = strings.ToLower(t.val)
+	}
+
+	l.currentToken = t
+	return l.currentToken, nil
 }
 
-func (l *Lexer) keywordOrId(first int) {
-	str := string(first)
+func (l *Lexer) keywordOrId(first int) (*Token, *Error) {
+	start := l.pos
+	start.column--
+	start.offset--
+	l.buf = append(l.buf[:0], byte(first))
 
-	for c := l.peek(); unicode.IsLetter(rune(c)); c = l.peek() {
-		l.readNext()
-		str += string(c)
+	for c := l.peek(); isLetter(c) || isDigit(c); c = l.peek() {
+		l.buf = append(l.buf, byte(l.readNext()))
+		if err := l.checkTokenLength(start); err != nil {
+			return nil, err
+		}
 	}
 
-	if typ, ok := keywordsStr2Token[str]; ok {
-		l.currentToken = l.makeToken(typ, "", len(str))
+	if typ, ok := keywordsStr2Token[string(l.buf)]; ok {
+		l.currentToken = l.makeToken(typ, "", len(l.buf))
 	} else {
-		l.currentToken = l.makeToken(TId, str, len(str))
+		l.currentToken = l.makeToken(TId, string(l.buf), len(l.buf))
+	}
+
+	return l.currentToken, nil
+}
+
+func (t TokenType) IsKeyword() bool {
+	return t >= TAnd && t < keywordEnd
+}
+
+func (t TokenType) IsOperator() bool {
+	return t >= TAssign && t < operatorEnd
+}
+
+// 一组token类型，用来代替判断"是不是其中之一"的switch
+type TokenSet map[TokenType]struct{}
+
+func NewTokenSet(types ...TokenType) TokenSet {
+	s := make(TokenSet, len(types))
+	for _, t := range types {
+		s[t] = struct{}{}
+	}
+
+	return s
+}
+
+func (s TokenSet) Contains(t TokenType) bool {
+	_, ok := s[t]
+	return ok
+}
+
+func (t TokenType) String() string {
+	if name, ok := tokenName[t]; ok {
+		return name
 	}
+
+	if name, ok := keywordsToken2Str[t]; ok {
+		return name
+	}
+
+	return "unknown"
 }
 
-func (l *Lexer) makeToken(typ tokenType, val string, tokenLen int) *Token {
+func (l *Lexer) makeToken(typ TokenType, val string, tokenLen int) *Token {
 	return &Token{
 		pos: Position{
 			line:     l.pos.line,
 			column:   l.pos.column - tokenLen,
+			offset:   l.pos.offset - tokenLen,
 			fileName: l.pos.fileName,
 		},
+		end: l.pos,
 		typ: typ,
 		val: val,
 	}
 }
 
+// 会先把src全部读出来再扫描，读取出错时第一次Scan返回这个错误
 func InitLexer(src *bufio.Reader, fileName string) *Lexer {
 	l := Lexer{}
+	l.Reset(src, fileName)
+	return &l
+}
+
+func InitLexerBytes(src []byte, fileName string) *Lexer {
+	l := Lexer{}
+	l.ResetBytes(src, fileName)
+	return &l
+}
+
+// 复用Lexer扫描新的输入，预读的token和记录的错误都会被丢弃，容错模式等设置保留。
+// 读取出错时第一次Scan返回这个错误，之后扫描已经读到的部分
+func (l *Lexer) Reset(src *bufio.Reader, fileName string) {
+	data, err := io.ReadAll(src)
+	l.ResetBytes(data, fileName)
+
+	if err != nil {
+		l.readErr = &Error{
+			pos: Position{fileName: fileName},
+			msg: err.Error(),
+		}
+	}
+}
+
+func (l *Lexer) ResetBytes(src []byte, fileName string) {
 	l.src = src
 	l.pos = Position{
 		line:     1,
 		column:   1,
 		fileName: fileName,
 	}
-	return &l
+	l.prevToken, l.currentToken = nil, nil
+	l.buffer, l.cursor, l.marks = l.buffer[:0], 0, l.marks[:0]
+	l.lineStarts = append(l.lineStarts[:0], 0)
+	l.errors = nil
+	l.comments = nil
+	l.readErr = nil
+}
+
+// 返回源码中[start, end)之间的原始文本，比如token或者节点的Pos和End
+func (l *Lexer) Slice(start, end Position) (string, *Error) {
+	if start.offset < 0 || start.offset > end.offset || end.offset > len(l.src) {
+		return "", &Error{
+			pos: start,
+			msg: fmt.Sprintf("invalid source range %d-%d", start.offset, end.offset),
+		}
+	}
+
+	return string(l.src[start.offset:end.offset]), nil
+}
+
+// 只能转换已经扫描过的部分，超出范围时返回错误
+func (l *Lexer) OffsetToPosition(off int) (Position, *Error) {
+	if off < 0 || off > l.pos.offset || len(l.lineStarts) == 0 {
+		return Position{}, &Error{
+			pos: l.pos,
+			msg: fmt.Sprintf("offset %d out of scanned range 0-%d", off, l.pos.offset),
+		}
+	}
+
+	i := sort.Search(len(l.lineStarts), func(i int) bool {
+		return l.lineStarts[i] > off
+	}) - 1
+
+	return Position{
+		line:     i + 1,
+		column:   off - l.lineStarts[i] + 1,
+		offset:   off,
+		fileName: l.pos.fileName,
+	}, nil
+}
+
+// 行和列从1开始，不在已经扫描过的范围内时返回错误，列可以指向行末的换行符
+func (l *Lexer) PositionToOffset(line, column int) (int, *Error) {
+	if line >= 1 && line <= len(l.lineStarts) && column >= 1 {
+		start := l.lineStarts[line-1]
+		end := l.pos.offset // 最后一行可以指向扫描结束的位置
+		if line < len(l.lineStarts) {
+			end = l.lineStarts[line] - 1
+		}
+
+		if off := start + column - 1; off <= end {
+			return off, nil
+		}
+	}
+
+	return -1, &Error{
+		pos: l.pos,
+		msg: fmt.Sprintf("position %d:%d out of scanned range", line, column),
+	}
 }
 
 func (l *Lexer) peek() int {
-	if c, err := l.src.ReadByte(); err != io.EOF {
-		_ = l.src.UnreadByte()
-		return int(c)
+	if l.pos.offset < len(l.src) {
+		return int(l.src[l.pos.offset])
 	}
 
 	return EOF
 }
 
+func (l *Lexer) peek2() int {
+	if l.pos.offset+1 < len(l.src) {
+		return int(l.src[l.pos.offset+1])
+	}
+
+	return EOF
+}
+
+// 和lua一样，名字只能由ASCII字母、数字和_组成
+func isLetter(c int) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isDigit(c int) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c int) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// 读到c之后调用，\n、\r\n和单独的\r都只算一次换行
+func (l *Lexer) checkNewLine(c int) {
+	if c == '\n' || c == '\r' && l.peek() != '\n' {
+		l.newLine()
+	}
+}
+
 func (l *Lexer) newLine() {
 	l.pos.column = 1
 	l.pos.line++
+	l.lineStarts = append(l.lineStarts, l.pos.offset)
 }
 
 func (l *Lexer) readNext() int {
-	if c, err := l.src.ReadByte(); err != io.EOF {
+	if l.pos.offset < len(l.src) {
+		c := l.src[l.pos.offset]
 		l.pos.column++
+		l.pos.offset++
 		return int(c)
 	}
 
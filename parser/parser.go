@@ -3,42 +3,1288 @@ package parser
 import (
 	"bufio"
 	"fmt"
-	"log"
 	"os"
-	"strings"
+	"sort"
 )
 
-func Parse() {
-	fileName := "_lua5.1-tests/literals.lua"
+// 输出文件里的所有token，读到文件末尾时返回nil
+func Parse(fileName string) (perr *Error) {
 	f, err := os.Open(fileName)
 	if err != nil {
-		log.Fatal(err)
+		return &Error{
+			pos: Position{fileName: fileName},
+			msg: err.Error(),
+		}
 	}
 	defer func() {
-		if err = f.Close(); err != nil {
-			log.Fatal(err)
+		if err := f.Close(); err != nil && perr == nil {
+			perr = &Error{
+				pos: Position{fileName: fileName},
+				msg: err.Error(),
+			}
 		}
 	}()
 
 	l := InitLexer(bufio.NewReader(f), fileName)
-	keywordsToken2Str := make(map[tokenType]string)
 
-	for k, v := range keywordsStr2Token {
-		keywordsToken2Str[v] = k
+	for {
+		t, err := l.Scan()
+
+		if err != nil {
+			if err.eof {
+				return nil
+			}
+			return err
+		}
+
+		fmt.Printf("line %d column(%d) %s\t%s\n", t.pos.line, t.pos.column, t.typ, t.val)
+	}
+}
+
+const tEOF TokenType = EOF
+
+type parser struct {
+	l     *Lexer
+	gotos []*GotoStmt // 当前函数里还没找到label的goto
+}
+
+// 二元运算符的左右优先级，右结合的运算符右边优先级更低，和lua 5.3一致
+var binaryPriority = map[TokenType][2]int{
+	TOr: {1, 1}, TAnd: {2, 2},
+	TEq: {3, 3}, TNe: {3, 3}, TLt: {3, 3}, TGt: {3, 3}, TLte: {3, 3}, TGte: {3, 3},
+	TPipe: {4, 4},
+	TBXor: {5, 5},
+	TAmp:  {6, 6},
+	TShl:  {7, 7}, TShr: {7, 7},
+	T2Dot: {9, 8},
+	TPlus: {10, 10}, TMinus: {10, 10},
+	TStar: {11, 11}, TSlash: {11, 11}, TDoubleSlash: {11, 11}, TPercent: {11, 11},
+	TCaret: {14, 13},
+}
+
+const unaryPriority = 12
+
+// 一元运算符，优先级都是unaryPriority
+var unaryOps = map[TokenType]bool{
+	TPound: true,
+	TNot:   true,
+	TMinus: true,
+	TBXor:  true, // ~a 是按位取反
+}
+
+// 复合赋值对应的二元运算符
+var compoundAssignOp = map[TokenType]TokenType{
+	TPlusAssign:   TPlus,
+	TMinusAssign:  TMinus,
+	TConcatAssign: T2Dot,
+}
+
+func ParseExpr(l *Lexer) (Expr, *Error) {
+	p := parser{l: l}
+	return p.subExpr(0)
+}
+
+// 解析一个完整的表达式，给REPL用，表达式后面不能再有别的内容
+func ParseExprString(src string) (Expr, *Error) {
+	p := parser{l: InitLexerBytes([]byte(src), "stdin")}
+
+	e, err := p.subExpr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.expectEOF(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func ParseChunk(l *Lexer) (*Block, *Error) {
+	p := parser{l: l}
+
+	b, err := p.funcBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.expectEOF(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func ParseStatement(l *Lexer) (Stmt, *Error) {
+	p := parser{l: l}
+	return p.statement()
+}
+
+func (p *parser) expectEOF() *Error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+
+	if t.typ != tEOF {
+		return &Error{
+			pos: t.pos,
+			msg: fmt.Sprintf("'<eof>' expected near '%s'", describe(t)),
+		}
+	}
+
+	return nil
+}
+
+func exprAt(pos Position) expr {
+	return expr{node{pos: pos}}
+}
+
+// 只有一个token的表达式
+func exprOf(t *Token) expr {
+	return expr{node{pos: t.pos, end: t.end}}
+}
+
+func stmtAt(pos Position) stmt {
+	return stmt{node{pos: pos}}
+}
+
+func describe(t *Token) string {
+	switch {
+	case t.typ == tEOF:
+		return "<eof>"
+	case t.typ.IsKeyword() || t.typ.IsOperator():
+		return t.typ.String()
+	}
+
+	return t.val
+}
+
+func unexpected(t *Token) *Error {
+	return &Error{
+		pos: t.pos,
+		msg: fmt.Sprintf("unexpected symbol near '%s'", describe(t)),
+	}
+}
+
+// 读到文件末尾时返回tEOF，而不是错误
+func (p *parser) peek() (*Token, *Error) {
+	t, err := p.l.PeekToken()
+	if err != nil && err.eof {
+		return &Token{pos: err.pos, end: err.pos, typ: tEOF}, nil
+	}
+
+	return t, err
+}
+
+func (p *parser) next() (*Token, *Error) {
+	t, err := p.l.Scan()
+	if err != nil && err.eof {
+		return &Token{pos: err.pos, end: err.pos, typ: tEOF}, nil
+	}
+
+	return t, err
+}
+
+func (p *parser) expect(typ TokenType) (*Token, *Error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.typ != typ {
+		return nil, &Error{
+			pos: t.pos,
+			msg: fmt.Sprintf("'%s' expected near '%s'", typ, describe(t)),
+		}
+	}
+
+	return t, nil
+}
+
+// 和expect一样，但错误信息里带上对应的开始token
+func (p *parser) expectClose(typ TokenType, open *Token) (*Token, *Error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.typ != typ {
+		return nil, &Error{
+			pos: t.pos,
+			msg: fmt.Sprintf("'%s' expected (to close '%s' at line %d) near '%s'",
+				typ, open.typ, open.pos.line, describe(t)),
+		}
+	}
+
+	return t, nil
+}
+
+// 优先级高于limit的运算符才会被当前层吃掉
+func (p *parser) subExpr(limit int) (Expr, *Error) {
+	var e Expr
+
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	if unaryOps[t.typ] {
+		_, _ = p.next()
+		operand, err := p.subExpr(unaryPriority)
+		if err != nil {
+			return nil, err
+		}
+
+		e = &UnOpExpr{expr: exprAt(t.pos), Op: t.typ, Operand: operand}
+		e.setEnd(operand.End())
+	} else if e, err = p.simpleExpr(); err != nil {
+		return nil, err
 	}
 
 	for {
-		t, err := l.Scan()
+		t, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		priority, ok := binaryPriority[t.typ]
+		if !ok || priority[0] <= limit {
+			return e, nil
+		}
 
+		_, _ = p.next()
+		rhs, err := p.subExpr(priority[1])
 		if err != nil {
-			fmt.Println(err)
-			break
+			return nil, err
+		}
+
+		e = &BinOpExpr{expr: exprAt(e.Pos()), Op: t.typ, Lhs: e, Rhs: rhs}
+		e.setEnd(rhs.End())
+	}
+}
+
+func (p *parser) simpleExpr() (Expr, *Error) {
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t.typ {
+	case TNumber:
+		_, _ = p.next()
+		v, isInt := t.Number()
+		return &NumberExpr{expr: exprOf(t), Value: v, IsInt: isInt, Int: t.Int()}, nil
+	case TStr:
+		_, _ = p.next()
+		return &StringExpr{expr: exprOf(t), Value: t.val}, nil
+	case TNil:
+		_, _ = p.next()
+		return &NilExpr{expr: exprOf(t)}, nil
+	case TTrue, TFalse:
+		_, _ = p.next()
+		return &BoolExpr{expr: exprOf(t), Value: t.typ == TTrue}, nil
+	case T3Dot:
+		_, _ = p.next()
+		return &VarargExpr{expr: exprOf(t)}, nil
+	case TFunction:
+		open, _ := p.next()
+		return p.funcBody(open, false)
+	case TOpenBrace:
+		return p.tableConstructor()
+	}
+
+	return p.suffixedExpr()
+}
+
+func (p *parser) primaryExpr() (Expr, *Error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t.typ {
+	case TId:
+		return &NameExpr{expr: exprOf(t), Name: t.val}, nil
+	case TRequire:
+		return p.requireExpr(t)
+	case TLeftParent:
+		inner, err := p.subExpr(0)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = p.expectClose(TRightParent, t); err != nil {
+			return nil, err
+		}
+
+		e := &ParenExpr{expr: exprAt(t.pos), Inner: inner}
+		e.setEnd(p.l.currentToken.end)
+		return e, nil
+	}
+
+	return nil, unexpected(t)
+}
+
+// primaryExpr { '.' name | '[' expr ']' | ':' name args | args }
+func (p *parser) suffixedExpr() (Expr, *Error) {
+	e, err := p.primaryExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t.typ {
+		case TDot:
+			_, _ = p.next()
+			name, err := p.expect(TId)
+			if err != nil {
+				return nil, err
+			}
+
+			key := &StringExpr{expr: exprOf(name), Value: name.val}
+			e = &IndexExpr{expr: exprAt(e.Pos()), Obj: e, Key: key}
+		case TLeftBracket:
+			_, _ = p.next()
+			key, err := p.subExpr(0)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err = p.expectClose(TRightBracket, t); err != nil {
+				return nil, err
+			}
+
+			e = &IndexExpr{expr: exprAt(e.Pos()), Obj: e, Key: key}
+		case TColon:
+			_, _ = p.next()
+			name, err := p.expect(TId)
+			if err != nil {
+				return nil, err
+			}
+
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+
+			e = &FuncCallExpr{expr: exprAt(e.Pos()), Fn: e, Method: name.val, Args: args}
+		case TLeftParent, TStr, TOpenBrace:
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+
+			e = &FuncCallExpr{expr: exprAt(e.Pos()), Fn: e, Args: args}
+		default:
+			return e, nil
 		}
 
-		if t.typ > 1<<8 {
-			fmt.Printf("line %d column(%d) %s\t%s\n", t.pos.line, t.pos.column, strings.ToUpper(tokenName[t.typ]), t.val)
+		e.setEnd(p.l.currentToken.end) // 多行的调用也一直到最后一个token
+	}
+}
+
+// require string | require '(' expr ')'，后面不是这两种时require当成普通的函数值，比如 pcall(require, "m")
+func (p *parser) requireExpr(open *Token) (Expr, *Error) {
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &RequireExpr{expr: exprAt(open.pos)}
+
+	switch t.typ {
+	case TStr:
+		_, _ = p.next()
+		e.Module = t.val
+	case TLeftParent:
+		_, _ = p.next()
+		// 括号里可以是任意表达式，比如 require(name)
+		arg, err := p.subExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if str, ok := arg.(*StringExpr); ok {
+			e.Module = str.Value
 		} else {
-			fmt.Printf("line %d column(%d) %s\n", t.pos.line, t.pos.column, strings.ToUpper(keywordsToken2Str[t.typ]))
+			e.Arg = arg
+		}
+
+		if t, err = p.expectClose(TRightParent, t); err != nil {
+			return nil, err
+		}
+	default:
+		return &NameExpr{expr: exprOf(open), Name: "require"}, nil
+	}
+
+	e.setEnd(t.end)
+	return e, nil
+}
+
+// '(' [exprList] ')' | string | table
+func (p *parser) callArgs() ([]Expr, *Error) {
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.typ == TOpenBrace {
+		table, err := p.tableConstructor()
+		if err != nil {
+			return nil, err
+		}
+
+		return []Expr{table}, nil
+	}
+
+	_, _ = p.next()
+	switch t.typ {
+	case TStr:
+		return []Expr{&StringExpr{expr: exprOf(t), Value: t.val}}, nil
+	case TLeftParent:
+		next, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		var args []Expr
+		if next.typ != TRightParent {
+			if args, err = p.exprList(); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, err = p.expectClose(TRightParent, t); err != nil {
+			return nil, err
+		}
+
+		return args, nil
+	}
+
+	return nil, &Error{
+		pos: t.pos,
+		msg: fmt.Sprintf("function arguments expected near '%s'", describe(t)),
+	}
+}
+
+// '{' [field {sep field} [sep]] '}'，sep是,或者;
+func (p *parser) tableConstructor() (*TableExpr, *Error) {
+	open, _ := p.next()
+	table := &TableExpr{expr: exprAt(open.pos)}
+
+	for {
+		t, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		if t.typ == TCloseBrace {
+			break
+		}
+
+		f, err := p.tableField()
+		if err != nil {
+			return nil, err
+		}
+		table.Fields = append(table.Fields, f)
+
+		if t, err = p.peek(); err != nil {
+			return nil, err
+		}
+
+		if t.typ != TComma && t.typ != TSemicolon {
+			break
+		}
+		_, _ = p.next()
+	}
+
+	if _, err := p.expectClose(TCloseBrace, open); err != nil {
+		return nil, err
+	}
+
+	table.setEnd(p.l.currentToken.end)
+	return table, nil
+}
+
+// [expr] = expr | name = expr | expr
+func (p *parser) tableField() (*TableField, *Error) {
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &TableField{}
+	switch t.typ {
+	case TLeftBracket:
+		_, _ = p.next()
+		if f.Key, err = p.subExpr(0); err != nil {
+			return nil, err
+		}
+
+		if _, err = p.expectClose(TRightBracket, t); err != nil {
+			return nil, err
+		}
+
+		if _, err = p.expect(TAssign); err != nil {
+			return nil, err
+		}
+	case TId:
+		// 需要再往后看一个token才能区分 x = 1 和 x
+		tokens, err := p.l.LookaheadN(2)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(tokens) == 2 && tokens[1].typ == TAssign {
+			_, _ = p.next()
+			_, _ = p.next()
+			f.Key = &StringExpr{expr: exprOf(t), Value: t.val}
+		}
+	}
+
+	if f.Value, err = p.subExpr(0); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// '(' params ')' block end，open是function关键字
+func (p *parser) funcBody(open *Token, isMethod bool) (*FunctionExpr, *Error) {
+	f := &FunctionExpr{expr: exprAt(open.pos)}
+	if isMethod {
+		f.Params = append(f.Params, "self")
+	}
+
+	paren, err := p.expect(TLeftParent)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	for t.typ != TRightParent {
+		if t, err = p.next(); err != nil {
+			return nil, err
+		}
+
+		if t.typ == T3Dot {
+			f.IsVararg = true
+			break
+		} else if t.typ != TId {
+			return nil, &Error{
+				pos: t.pos,
+				msg: fmt.Sprintf("<name> expected near '%s'", describe(t)),
+			}
+		}
+		f.Params = append(f.Params, t.val)
+
+		if t, err = p.peek(); err != nil {
+			return nil, err
+		}
+
+		if t.typ != TComma {
+			break
+		}
+		_, _ = p.next()
+	}
+
+	closeParen, err := p.expectClose(TRightParent, paren)
+	if err != nil {
+		return nil, err
+	}
+	f.paramsEnd = closeParen.end
+
+	if f.Body, err = p.funcBlock(); err != nil {
+		return nil, err
+	}
+
+	end, err := p.expectClose(TEnd, open)
+	if err != nil {
+		return nil, err
+	}
+
+	f.setEnd(end.end)
+	return f, nil
+}
+
+func (p *parser) exprList() ([]Expr, *Error) {
+	var list []Expr
+
+	for {
+		e, err := p.subExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+
+		t, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		if t.typ != TComma {
+			return list, nil
 		}
+		_, _ = p.next()
 	}
 }
+
+func (p *parser) nameList() ([]string, *Error) {
+	var names []string
+
+	for {
+		t, err := p.expect(TId)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, t.val)
+
+		if t, err = p.peek(); err != nil {
+			return nil, err
+		}
+
+		if t.typ != TComma {
+			return names, nil
+		}
+		_, _ = p.next()
+	}
+}
+
+func (p *parser) statement() (Stmt, *Error) {
+	s, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+
+	s.setEnd(p.l.currentToken.end)
+	return s, nil
+}
+
+func (p *parser) parseStatement() (Stmt, *Error) {
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t.typ {
+	case TLocal:
+		return p.localStmt()
+	case TIf:
+		return p.ifStmt()
+	case TDo:
+		open, _ := p.next()
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = p.expectClose(TEnd, open); err != nil {
+			return nil, err
+		}
+
+		return &DoStmt{stmt: stmtAt(open.pos), Body: body}, nil
+	case TWhile:
+		return p.whileStmt()
+	case TRepeat:
+		return p.repeatStmt()
+	case TFor:
+		return p.forStmt()
+	case TBreak:
+		_, _ = p.next()
+		return &BreakStmt{stmt: stmtAt(t.pos)}, nil
+	case TGoto:
+		_, _ = p.next()
+		name, err := p.expect(TId)
+		if err != nil {
+			return nil, err
+		}
+
+		s := &GotoStmt{stmt: stmtAt(t.pos), Label: name.val}
+		p.gotos = append(p.gotos, s)
+		return s, nil
+	case TDoubleColon:
+		_, _ = p.next()
+		name, err := p.expect(TId)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = p.expect(TDoubleColon); err != nil {
+			return nil, err
+		}
+
+		return &LabelStmt{stmt: stmtAt(t.pos), Name: name.val}, nil
+	case TFunction:
+		return p.functionStmt()
+	case TReturn:
+		return p.returnStmt()
+	}
+
+	return p.exprStmt()
+}
+
+// 可以结束一个block的token
+var BlockFollow = NewTokenSet(TEnd, TElse, TElseif, TUntil, tEOF)
+
+// 函数体，goto不能跳出函数，所以结束时所有goto都必须找到label
+func (p *parser) funcBlock() (*Block, *Error) {
+	outer := p.gotos
+	p.gotos = nil
+	defer func() { p.gotos = outer }()
+
+	b, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.gotos) > 0 {
+		g := p.gotos[0]
+		return nil, &Error{
+			pos: g.pos,
+			msg: fmt.Sprintf("no visible label '%s' for goto at line %d", g.Label, g.pos.line),
+		}
+	}
+
+	return b, nil
+}
+
+// 用当前block的label解决里面的goto，剩下的留给外层block，follow是结束block的token
+func (p *parser) resolveGotos(b *Block, start int, follow TokenType) *Error {
+	labels := make(map[string]int) // label在b.Stmts中的下标
+	for i, s := range b.Stmts {
+		l, ok := s.(*LabelStmt)
+		if !ok {
+			continue
+		}
+
+		if prev, ok := labels[l.Name]; ok {
+			return &Error{
+				pos: l.pos,
+				msg: fmt.Sprintf("label '%s' already defined on line %d", l.Name, b.Stmts[prev].Pos().line),
+			}
+		}
+		labels[l.Name] = i
+	}
+
+	pending := p.gotos[:start]
+	for _, g := range p.gotos[start:] {
+		i, ok := labels[g.Label]
+		if !ok {
+			pending = append(pending, g)
+			continue
+		}
+
+		if err := checkGotoScope(b, g, i, follow); err != nil {
+			return err
+		}
+	}
+	p.gotos = pending
+
+	return nil
+}
+
+// 向前跳时不能跳进中间声明的local的作用域，
+// 除非label在block末尾（后面只有label），这时local的作用域已经结束了。
+// 和lua 5.3一样，until的条件还能看到local，所以repeat里的label不算在末尾
+func checkGotoScope(b *Block, g *GotoStmt, label int, follow TokenType) *Error {
+	// 包含goto的语句，goto可能在里层的block中
+	from := sort.Search(len(b.Stmts), func(i int) bool {
+		return b.Stmts[i].Pos().offset > g.pos.offset
+	}) - 1
+
+	atEnd := follow != TUntil
+	for _, s := range b.Stmts[label+1:] {
+		if _, ok := s.(*LabelStmt); !ok {
+			atEnd = false
+			break
+		}
+	}
+
+	if label < from || atEnd {
+		return nil
+	}
+
+	for _, s := range b.Stmts[from+1 : label] {
+		var name string
+		switch s := s.(type) {
+		case *LocalStmt:
+			name = s.Names[0]
+		case *LocalFunctionStmt:
+			name = s.Name
+		default:
+			continue
+		}
+
+		return &Error{
+			pos: g.pos,
+			msg: fmt.Sprintf("<goto %s> at line %d jumps into the scope of local '%s'", g.Label, g.pos.line, name),
+		}
+	}
+
+	return nil
+}
+
+func (p *parser) block() (*Block, *Error) {
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	b := &Block{node: node{pos: t.pos}}
+	start := len(p.gotos)
+
+	for !BlockFollow.Contains(t.typ) {
+		// ;是空语句，直接跳过
+		if t.typ == TSemicolon {
+			_, _ = p.next()
+			if t, err = p.peek(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		b.Stmts = append(b.Stmts, s)
+
+		// return必须是block的最后一条语句
+		if _, ok := s.(*ReturnStmt); ok {
+			break
+		}
+
+		if t, err = p.peek(); err != nil {
+			return nil, err
+		}
+	}
+
+	if t, err = p.peek(); err != nil {
+		return nil, err
+	}
+	b.end = t.pos
+
+	if err = p.resolveGotos(b, start, t.typ); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// 条件后面紧跟=多半是把==写成了=，单独给出更明确的错误
+func (p *parser) condExpr() (Expr, *Error) {
+	cond, err := p.subExpr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.typ == TAssign {
+		return nil, &Error{
+			pos: t.pos,
+			msg: "unexpected '=' in condition, did you mean '=='?",
+		}
+	}
+
+	return cond, nil
+}
+
+// cond then block
+func (p *parser) condBlock() (*IfBranch, *Error) {
+	cond, err := p.condExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = p.expect(TThen); err != nil {
+		return nil, err
+	}
+
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+
+	return &IfBranch{Cond: cond, Body: body}, nil
+}
+
+func (p *parser) ifStmt() (Stmt, *Error) {
+	open, _ := p.next()
+	s := &IfStmt{stmt: stmtAt(open.pos)}
+
+	for {
+		branch, err := p.condBlock()
+		if err != nil {
+			return nil, err
+		}
+		s.Branches = append(s.Branches, branch)
+
+		t, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		if t.typ != TElseif {
+			break
+		}
+		_, _ = p.next()
+	}
+
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.typ == TElse {
+		_, _ = p.next()
+		if s.Else, err = p.block(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err = p.expectClose(TEnd, open); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (p *parser) localStmt() (Stmt, *Error) {
+	t, _ := p.next()
+
+	open, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	if open.typ == TFunction {
+		_, _ = p.next()
+		name, err := p.expect(TId)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := p.funcBody(open, false)
+		if err != nil {
+			return nil, err
+		}
+
+		return &LocalFunctionStmt{stmt: stmtAt(t.pos), Name: name.val, Func: f}, nil
+	}
+
+	names, err := p.nameList()
+	if err != nil {
+		return nil, err
+	}
+	s := &LocalStmt{stmt: stmtAt(t.pos), Names: names}
+
+	if t, err = p.peek(); err != nil {
+		return nil, err
+	}
+
+	if t.typ == TAssign {
+		_, _ = p.next()
+		if s.Values, err = p.exprList(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// 以表达式开头的语句，函数调用或者赋值
+func (p *parser) exprStmt() (Stmt, *Error) {
+	start, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []Expr
+
+	for {
+		e, err := p.suffixedExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		if call, ok := e.(*FuncCallExpr); ok && len(targets) == 0 {
+			t, err := p.peek()
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := compoundAssignOp[t.typ]; !ok && t.typ != TAssign && t.typ != TComma {
+				return &FuncCallStmt{stmt: stmtAt(start.pos), Call: call}, nil
+			}
+		}
+
+		// require "mod" 单独作为语句
+		if req, ok := e.(*RequireExpr); ok && len(targets) == 0 {
+			return &RequireStmt{stmt: stmtAt(start.pos), Require: req}, nil
+		}
+
+		if !assignable(e) {
+			return nil, &Error{pos: e.Pos(), msg: "syntax error: cannot assign to expression"}
+		}
+		targets = append(targets, e)
+
+		t, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		// a += 1 只能有一个目标
+		if op, ok := compoundAssignOp[t.typ]; ok && len(targets) == 1 {
+			_, _ = p.next()
+			value, err := p.subExpr(0)
+			if err != nil {
+				return nil, err
+			}
+
+			return &CompoundAssignStmt{stmt: stmtAt(start.pos), Op: op, Target: e, Value: value}, nil
+		}
+
+		if t.typ != TComma {
+			break
+		}
+		_, _ = p.next()
+	}
+
+	if _, err = p.expect(TAssign); err != nil {
+		return nil, err
+	}
+
+	values, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+
+	return &AssignStmt{stmt: stmtAt(start.pos), Targets: targets, Values: values}, nil
+}
+
+func assignable(e Expr) bool {
+	switch e.(type) {
+	case *NameExpr, *IndexExpr:
+		return true
+	}
+
+	return false
+}
+
+func (p *parser) whileStmt() (Stmt, *Error) {
+	open, _ := p.next()
+
+	cond, err := p.condExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = p.expect(TDo); err != nil {
+		return nil, err
+	}
+
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = p.expectClose(TEnd, open); err != nil {
+		return nil, err
+	}
+
+	return &WhileStmt{stmt: stmtAt(open.pos), Cond: cond, Body: body}, nil
+}
+
+func (p *parser) repeatStmt() (Stmt, *Error) {
+	open, _ := p.next()
+
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = p.expectClose(TUntil, open); err != nil {
+		return nil, err
+	}
+
+	cond, err := p.condExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	return &RepeatStmt{stmt: stmtAt(open.pos), Body: body, Cond: cond}, nil
+}
+
+// do block end
+func (p *parser) forBody(open *Token) (*Block, *Error) {
+	if _, err := p.expect(TDo); err != nil {
+		return nil, err
+	}
+
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = p.expectClose(TEnd, open); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+func (p *parser) forStmt() (Stmt, *Error) {
+	open, _ := p.next()
+
+	name, err := p.expect(TId)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	// 根据第一个名字后面的token区分数值for和泛型for
+	switch t.typ {
+	case TAssign:
+		_, _ = p.next()
+		s := &ForNumStmt{stmt: stmtAt(open.pos), Var: name.val}
+
+		if s.Start, err = p.subExpr(0); err != nil {
+			return nil, err
+		}
+
+		if _, err = p.expect(TComma); err != nil {
+			return nil, err
+		}
+
+		if s.Stop, err = p.subExpr(0); err != nil {
+			return nil, err
+		}
+
+		if t, err = p.peek(); err != nil {
+			return nil, err
+		}
+
+		if t.typ == TComma {
+			_, _ = p.next()
+			if s.Step, err = p.subExpr(0); err != nil {
+				return nil, err
+			}
+		}
+
+		if s.Body, err = p.forBody(open); err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	case TComma, TIn:
+		s := &ForInStmt{stmt: stmtAt(open.pos), Names: []string{name.val}}
+
+		if t.typ == TComma {
+			_, _ = p.next()
+			names, err := p.nameList()
+			if err != nil {
+				return nil, err
+			}
+			s.Names = append(s.Names, names...)
+		}
+
+		if _, err = p.expect(TIn); err != nil {
+			return nil, err
+		}
+
+		if s.Exprs, err = p.exprList(); err != nil {
+			return nil, err
+		}
+
+		if s.Body, err = p.forBody(open); err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	}
+
+	return nil, &Error{
+		pos: t.pos,
+		msg: fmt.Sprintf("'=' or 'in' expected near '%s'", describe(t)),
+	}
+}
+
+// function a.b.c:m() end
+func (p *parser) functionStmt() (Stmt, *Error) {
+	open, _ := p.next()
+
+	t, err := p.expect(TId)
+	if err != nil {
+		return nil, err
+	}
+	var name Expr = &NameExpr{expr: exprOf(t), Name: t.val}
+	isMethod := false
+
+	for !isMethod {
+		if t, err = p.peek(); err != nil {
+			return nil, err
+		}
+
+		if t.typ != TDot && t.typ != TColon {
+			break
+		}
+		_, _ = p.next()
+		isMethod = t.typ == TColon
+
+		key, err := p.expect(TId)
+		if err != nil {
+			return nil, err
+		}
+		name = &IndexExpr{expr: exprAt(name.Pos()), Obj: name, Key: &StringExpr{expr: exprOf(key), Value: key.val}}
+		name.setEnd(key.end)
+	}
+
+	f, err := p.funcBody(open, isMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FunctionStmt{stmt: stmtAt(open.pos), Name: name, IsMethod: isMethod, Func: f}, nil
+}
+
+func (p *parser) returnStmt() (Stmt, *Error) {
+	t, _ := p.next()
+	s := &ReturnStmt{stmt: stmtAt(t.pos)}
+
+	next, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	if !BlockFollow.Contains(next.typ) && next.typ != TSemicolon {
+		if s.Values, err = p.exprList(); err != nil {
+			return nil, err
+		}
+		if next, err = p.peek(); err != nil {
+			return nil, err
+		}
+	}
+
+	// return 后面可以跟一个;
+	if next.typ == TSemicolon {
+		_, _ = p.next()
+	}
+
+	return s, nil
+}
@@ -0,0 +1,840 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 把表达式写成前缀形式，方便比较树的形状
+func sexpr(e Node) string {
+	switch e := e.(type) {
+	case *NumberExpr:
+		return fmt.Sprint(e.Value)
+	case *StringExpr:
+		return fmt.Sprintf("%q", e.Value)
+	case *NameExpr:
+		return e.Name
+	case *ParenExpr:
+		return "(" + sexpr(e.Inner) + ")"
+	case *BinOpExpr:
+		return "(" + e.Op.String() + " " + sexpr(e.Lhs) + " " + sexpr(e.Rhs) + ")"
+	case *UnOpExpr:
+		return "(" + e.Op.String() + " " + sexpr(e.Operand) + ")"
+	case *IndexExpr:
+		return "(index " + sexpr(e.Obj) + " " + sexpr(e.Key) + ")"
+	case *FuncCallExpr:
+		s := "(call " + sexpr(e.Fn)
+		if e.Method != "" {
+			s += ":" + e.Method
+		}
+		for _, a := range e.Args {
+			s += " " + sexpr(a)
+		}
+		return s + ")"
+	}
+	return fmt.Sprintf("%T", e)
+}
+
+func TestParseFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.lua")
+	if err := os.WriteFile(name, []byte("local a = 1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Parse(name); err != nil {
+		t.Fatal(err)
+	}
+
+	// 扫描错误带着传进来的文件名返回
+	bad := filepath.Join(dir, "b.lua")
+	if err := os.WriteFile(bad, []byte("local a = $"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Parse(bad); err == nil || err.pos.fileName != bad || err.pos.column != 11 {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// 打开或读取失败时返回错误，而不是让进程退出
+func TestParseOpenError(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.lua")
+	if err := Parse(missing); err == nil || err.pos.fileName != missing || err.eof {
+		t.Fatalf("missing file: got %v", err)
+	}
+
+	// 目录可以打开但是读取会失败
+	if err := Parse(dir); err == nil {
+		t.Fatal("directory: want error")
+	}
+}
+
+func TestGoto(t *testing.T) {
+	ok := []string{
+		"goto done ::done::",
+		"::top:: x = 1 goto top",
+		"for i = 1, 3 do if i == 2 then goto continue end f(i) ::continue:: end",
+		"for i = 1, 3 do if i == 2 then goto continue end local y = i ::continue:: end",
+		"if x then goto a end ::a::",
+		"::a:: while x do ::a:: end",
+		"goto l local x = 1 ::l::",
+		"do goto l local x = 1 ::l:: ::m:: end",
+		"goto l do local x = 1 end ::l:: print(x)",
+		"local x = 1 goto l ::l:: print(x)",
+		"::l:: local x = 1 goto l",
+	}
+	for _, src := range ok {
+		if _, err := ParseChunk(lex(src)); err != nil {
+			t.Errorf("%s: %s", src, err)
+		}
+	}
+
+	bad := map[string]string{
+		"goto missing":                                              "no visible label 'missing' for goto at line 1",
+		"if x then ::a:: end goto a":                                "no visible label 'a' for goto at line 1",
+		"::a:: f = function() goto a end":                           "no visible label 'a' for goto at line 1",
+		"::a:: x = 1\n::a::":                                        "label 'a' already defined on line 1",
+		"local function f()\n goto b\nend ::b::":                    "no visible label 'b' for goto at line 2",
+		"goto l local x = 1 ::l:: print(x)":                         "<goto l> at line 1 jumps into the scope of local 'x'",
+		"if a then\n goto l\nend\nlocal function f() end ::l:: f()": "<goto l> at line 2 jumps into the scope of local 'f'",
+		"repeat goto l local x ::l:: until x":                       "<goto l> at line 1 jumps into the scope of local 'x'",
+	}
+	for src, msg := range bad {
+		if _, err := ParseChunk(lex(src)); err == nil || err.msg != msg {
+			t.Errorf("%s: got %v", src, err)
+		}
+	}
+}
+
+func TestParseBitwise(t *testing.T) {
+	cases := map[string]string{
+		"a & b | c ~ d << 1 .. x": "(| (& a b) (~ c (<< d (.. 1 x))))",
+		"~a":                      "(~ a)",
+		"~a & b":                  "(& (~ a) b)",
+		"a ~ ~b":                  "(~ a (~ b))",
+		"~~a":                     "(~ (~ a))",
+		"2 ^ ~a":                  "(^ 2 (~ a))",
+		"~a ^ 2":                  "(~ (^ a 2))",
+	}
+
+	for src, want := range cases {
+		e, err := ParseExprString(src)
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if got := sexpr(e); got != want {
+			t.Errorf("%s: got %s, want %s", src, got, want)
+		}
+	}
+}
+
+func TestParseConcat(t *testing.T) {
+	// ..是右结合的，优先级低于算术运算
+	cases := map[string]string{
+		"a..b..c":          "(.. a (.. b c))",
+		`"x" .. 1 .. y`:    `(.. "x" (.. 1 y))`,
+		"a .. b + c .. d":  "(.. a (.. (+ b c) d))",
+		"(a .. b) .. c":    "(.. ((.. a b)) c)",
+		"a .. b == c .. d": "(== (.. a b) (.. c d))",
+	}
+
+	for src, want := range cases {
+		e, err := ParseExprString(src)
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if got := sexpr(e); got != want {
+			t.Errorf("%s: got %s, want %s", src, got, want)
+		}
+	}
+}
+
+func TestParseExprPrecedence(t *testing.T) {
+	cases := map[string]string{
+		"1 + 2 * 3":     "(+ 1 (* 2 3))",
+		"2 ^ 2 ^ 3":     "(^ 2 (^ 2 3))",
+		"1 - 2 - 3":     "(- (- 1 2) 3)",
+		"8 / 4 % 3":     "(% (/ 8 4) 3)",
+		"(1 + 2) * x":   "(* ((+ 1 2)) x)",
+		"a < b == c":    "(== (< a b) c)",
+		"1 + 2 < 3 * 4": "(< (+ 1 2) (* 3 4))",
+	}
+
+	for src, want := range cases {
+		e, err := ParseExprString(src)
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if got := sexpr(e); got != want {
+			t.Errorf("%s: got %s, want %s", src, got, want)
+		}
+	}
+
+	bad := map[string]string{
+		"(1 + 2": "')' expected (to close '(' at line 1) near '<eof>'",
+		"1 +":    "unexpected symbol near '<eof>'",
+		"* 2":    "unexpected symbol near '*'",
+		"1 2":    "'<eof>' expected near '2'",
+	}
+	for src, msg := range bad {
+		if _, err := ParseExprString(src); err == nil || err.msg != msg {
+			t.Errorf("%s: got %v", src, err)
+		}
+	}
+}
+
+func TestParseLocalAndAssign(t *testing.T) {
+	s, err := ParseStatement(lex("local a"))
+	if ls, ok := s.(*LocalStmt); err != nil || !ok || len(ls.Names) != 1 || ls.Values != nil {
+		t.Fatal(s, err)
+	}
+
+	s, err = ParseStatement(lex("local a, b, c = 1, x + 2"))
+	ls, ok := s.(*LocalStmt)
+	if err != nil || !ok || fmt.Sprint(ls.Names) != "[a b c]" || len(ls.Values) != 2 || sexpr(ls.Values[1]) != "(+ x 2)" {
+		t.Fatal(s, err)
+	}
+
+	s, err = ParseStatement(lex("x, t.k, t[1] = y, x"))
+	as, ok := s.(*AssignStmt)
+	if err != nil || !ok || len(as.Targets) != 3 || len(as.Values) != 2 || sexpr(as.Values[0]) != "y" {
+		t.Fatal(s, err)
+	}
+	if _, ok := as.Targets[1].(*IndexExpr); !ok {
+		t.Fatalf("got %T", as.Targets[1])
+	}
+
+	bad := map[string]string{
+		"local = 1": "'<name>' expected near '='",
+		"local a,":  "'<name>' expected near '<eof>'",
+		"(a) = 1":   "syntax error: cannot assign to expression",
+		"x =":       "unexpected symbol near '<eof>'",
+		"x, 1 = 2":  "unexpected symbol near '1'",
+	}
+	for src, msg := range bad {
+		if _, err := ParseStatement(lex(src)); err == nil || err.msg != msg {
+			t.Errorf("%s: got %v", src, err)
+		}
+	}
+}
+
+func TestParseVarargLocal(t *testing.T) {
+	s, err := ParseStatement(lex("local a, b = ..."))
+	ls, ok := s.(*LocalStmt)
+	if err != nil || !ok || len(ls.Names) != 2 || len(ls.Values) != 1 {
+		t.Fatal(s, err)
+	}
+	if _, ok := ls.Values[0].(*VarargExpr); !ok {
+		t.Fatalf("got %T", ls.Values[0])
+	}
+
+	tokens, errs := ScanAll("a .. b ... c", "x")
+	if len(errs) != 0 || len(tokens) != 5 || tokens[1].typ != T2Dot || tokens[3].typ != T3Dot {
+		t.Fatal(tokens, errs)
+	}
+}
+
+func TestParseIf(t *testing.T) {
+	s, err := ParseStatement(lex("if a then x = 1 end"))
+	is, ok := s.(*IfStmt)
+	if err != nil || !ok || len(is.Branches) != 1 || is.Else != nil || len(is.Branches[0].Body.Stmts) != 1 {
+		t.Fatal(s, err)
+	}
+
+	s, err = ParseStatement(lex("if a then x = 1 else x = 2 y = 3 end"))
+	is, ok = s.(*IfStmt)
+	if err != nil || !ok || len(is.Branches) != 1 || is.Else == nil || len(is.Else.Stmts) != 2 {
+		t.Fatal(s, err)
+	}
+
+	s, err = ParseStatement(lex("if a then elseif b then x = 1 elseif c == 1 then else end"))
+	is, ok = s.(*IfStmt)
+	if err != nil || !ok || len(is.Branches) != 3 || is.Else == nil {
+		t.Fatal(s, err)
+	}
+	for i, want := range []string{"a", "b", "(== c 1)"} {
+		if got := sexpr(is.Branches[i].Cond); got != want {
+			t.Errorf("branch %d: got %s", i, got)
+		}
+	}
+
+	bad := map[string]string{
+		"if a then\n x = 1\n":          "'end' expected (to close 'if' at line 1) near '<eof>'",
+		"if a x = 1 end":               "'then' expected near 'x'",
+		"if a then elseif b x = 1 end": "'then' expected near 'x'",
+		"if then end":                  "unexpected symbol near 'then'",
+	}
+	for src, msg := range bad {
+		if _, err := ParseStatement(lex(src)); err == nil || err.msg != msg {
+			t.Errorf("%s: got %v", src, err)
+		}
+	}
+}
+
+func TestParseLoops(t *testing.T) {
+	s, err := ParseStatement(lex("while a < 10 do a = a + 1 break end"))
+	ws, ok := s.(*WhileStmt)
+	if err != nil || !ok || sexpr(ws.Cond) != "(< a 10)" || len(ws.Body.Stmts) != 2 {
+		t.Fatal(s, err)
+	}
+	if _, ok := ws.Body.Stmts[1].(*BreakStmt); !ok {
+		t.Fatalf("got %T", ws.Body.Stmts[1])
+	}
+
+	s, err = ParseStatement(lex("repeat local x = 1 until x"))
+	rs, ok := s.(*RepeatStmt)
+	if err != nil || !ok || sexpr(rs.Cond) != "x" || len(rs.Body.Stmts) != 1 {
+		t.Fatal(s, err)
+	}
+
+	bad := map[string]string{
+		"while a a = 1 end": "'do' expected near 'a'",
+		"while a do":        "'end' expected (to close 'while' at line 1) near '<eof>'",
+		"repeat a = 1":      "'until' expected (to close 'repeat' at line 1) near '<eof>'",
+		"repeat until":      "unexpected symbol near '<eof>'",
+	}
+	for src, msg := range bad {
+		if _, err := ParseStatement(lex(src)); err == nil || err.msg != msg {
+			t.Errorf("%s: got %v", src, err)
+		}
+	}
+}
+
+func TestParseFor(t *testing.T) {
+	s, err := ParseStatement(lex("for i = 1, 10 do end"))
+	fn, ok := s.(*ForNumStmt)
+	if err != nil || !ok || fn.Var != "i" || sexpr(fn.Start) != "1" || sexpr(fn.Stop) != "10" || fn.Step != nil {
+		t.Fatal(s, err)
+	}
+
+	s, err = ParseStatement(lex("for i = 1, n, -2 do x = i end"))
+	fn, ok = s.(*ForNumStmt)
+	if err != nil || !ok || fn.Step == nil || sexpr(fn.Step) != "(- 2)" || len(fn.Body.Stmts) != 1 {
+		t.Fatal(s, err)
+	}
+
+	s, err = ParseStatement(lex("for k, v in pairs(t) do end"))
+	fi, ok := s.(*ForInStmt)
+	if err != nil || !ok || fmt.Sprint(fi.Names) != "[k v]" || len(fi.Exprs) != 1 {
+		t.Fatal(s, err)
+	}
+
+	s, err = ParseStatement(lex("for k in a, b, c do f(k) end"))
+	fi, ok = s.(*ForInStmt)
+	if err != nil || !ok || len(fi.Names) != 1 || len(fi.Exprs) != 3 || len(fi.Body.Stmts) != 1 {
+		t.Fatal(s, err)
+	}
+
+	bad := map[string]string{
+		"for k do end":           "'=' or 'in' expected near 'do'",
+		"for i = 1 do end":       "',' expected near 'do'",
+		"for i, j = 1, 2 do end": "'in' expected near '='",
+		"for i = 1, 2 x = 1 end": "'do' expected near 'x'",
+		"for k in t do":          "'end' expected (to close 'for' at line 1) near '<eof>'",
+	}
+	for src, msg := range bad {
+		if _, err := ParseStatement(lex(src)); err == nil || err.msg != msg {
+			t.Errorf("%s: got %v", src, err)
+		}
+	}
+}
+
+func TestParseFunctions(t *testing.T) {
+	s, err := ParseStatement(lex("function add(a, b) return a + b end"))
+	fs, ok := s.(*FunctionStmt)
+	if err != nil || !ok || fs.IsMethod || fmt.Sprint(fs.Func.Params) != "[a b]" || len(fs.Func.Body.Stmts) != 1 {
+		t.Fatal(s, err)
+	}
+
+	// 方法定义隐式带self参数
+	s, err = ParseStatement(lex("function a.b:m(x, ...) end"))
+	fs, ok = s.(*FunctionStmt)
+	if err != nil || !ok || !fs.IsMethod || fmt.Sprint(fs.Func.Params) != "[self x]" || !fs.Func.IsVararg {
+		t.Fatal(s, err)
+	}
+	if ix, ok := fs.Name.(*IndexExpr); !ok || sexpr(ix.Key) != `"m"` {
+		t.Fatal(fs.Name)
+	}
+
+	s, err = ParseStatement(lex("local function f(...) end"))
+	if lf, ok := s.(*LocalFunctionStmt); err != nil || !ok || lf.Name != "f" || len(lf.Func.Params) != 0 || !lf.Func.IsVararg {
+		t.Fatal(s, err)
+	}
+
+	calls := map[string]int{
+		"obj.list:push(1, 'x')": 2,
+		`print "hi"`:            1,
+		"f{1, 2}":               1,
+		"t.m()":                 0,
+		"f(a)(b, c)":            2,
+	}
+	for src, n := range calls {
+		s, err := ParseStatement(lex(src))
+		cs, ok := s.(*FuncCallStmt)
+		if err != nil || !ok || len(cs.Call.Args) != n {
+			t.Errorf("%s: got %v %v", src, s, err)
+		}
+	}
+
+	s, _ = ParseStatement(lex("obj.list:push(1)"))
+	if c := s.(*FuncCallStmt).Call; c.Method != "push" {
+		t.Errorf("got method %q", c.Method)
+	}
+
+	s, err = ParseStatement(lex("t[1].x, y = f(), function() end"))
+	if as, ok := s.(*AssignStmt); err != nil || !ok || len(as.Targets) != 2 {
+		t.Fatal(s, err)
+	}
+	if _, ok := s.(*AssignStmt).Values[1].(*FunctionExpr); !ok {
+		t.Fatalf("got %T", s.(*AssignStmt).Values[1])
+	}
+
+	bad := map[string]string{
+		"f(a,\n b":                        "')' expected (to close '(' at line 1) near '<eof>'",
+		"function f(a b) end":             "')' expected (to close '(' at line 1) near 'b'",
+		"f":                               "'=' expected near '<eof>'",
+		"function f() return 1 x = 2 end": "'end' expected (to close 'function' at line 1) near 'x'",
+		"a:m":                             "function arguments expected near '<eof>'",
+	}
+	for src, msg := range bad {
+		if _, err := ParseStatement(lex(src)); err == nil || err.msg != msg {
+			t.Errorf("%s: got %v", src, err)
+		}
+	}
+}
+
+func TestConcatAssign(t *testing.T) {
+	tokens, errs := ScanAll("a .. b ... c ..= d", "x")
+	if len(errs) != 0 || len(tokens) != 7 || tokens[1].typ != T2Dot || tokens[3].typ != T3Dot || tokens[5].typ != TConcatAssign {
+		t.Fatal(tokens, errs)
+	}
+
+	s, err := ParseStatement(lex(`s ..= "!"`))
+	cs, ok := s.(*CompoundAssignStmt)
+	if err != nil || !ok || cs.Op != T2Dot || sexpr(cs.Target) != "s" || sexpr(cs.Value) != `"!"` {
+		t.Fatal(s, err)
+	}
+	if out := Print(s); out != `s ..= "!"` {
+		t.Errorf("got %q", out)
+	}
+
+	s, err = ParseStatement(lex("t[i] += 1"))
+	if cs, ok := s.(*CompoundAssignStmt); err != nil || !ok || cs.Op != TPlus {
+		t.Fatal(s, err)
+	}
+
+	if _, err := ParseStatement(lex("a, b ..= 1")); err == nil {
+		t.Fatal("want error")
+	}
+	if _, err := ParseStatement(lex("f() ..= 1")); err == nil || err.msg != "syntax error: cannot assign to expression" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestParseFloorDiv(t *testing.T) {
+	cases := map[string]string{
+		"a + b // c * d": "(+ a (* (// b c) d))",
+		"a // b // c":    "(// (// a b) c)",
+		"-a // 2 ^ b":    "(// (- a) (^ 2 b))",
+	}
+
+	for src, want := range cases {
+		e, err := ParseExprString(src)
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if got := sexpr(e); got != want {
+			t.Errorf("%s: got %s, want %s", src, got, want)
+		}
+	}
+}
+
+func TestPoundPriority(t *testing.T) {
+	// #比..和算术运算绑定得紧，只有^比它高
+	cases := map[string]string{
+		`#t .. "x"`:    `(.. (# t) "x")`,
+		`#"ab" .. "c"`: `(.. (# "ab") "c")`,
+		"#t + 1":       "(+ (# t) 1)",
+		"#t * #u":      "(* (# t) (# u))",
+		"#t ^ 2":       "(# (^ t 2))",
+		"##t":          "(# (# t))",
+		"#(a .. b)":    "(# ((.. a b)))",
+	}
+
+	for src, want := range cases {
+		e, err := ParseExprString(src)
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if got := sexpr(e); got != want {
+			t.Errorf("%s: got %s, want %s", src, got, want)
+		}
+	}
+
+	src := "x = #t .. \"x\"\ny = #(a .. b)\n"
+	if out, err := Format(src, "x"); err != nil || out != src {
+		t.Fatalf("%q %v", out, err)
+	}
+}
+
+func TestMultiLineCallSpan(t *testing.T) {
+	b, err := ParseChunk(lex("f(\n  a,\n  b\n)\nx = t.k[1] + #y .. g\"s\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := b.Stmts[0].(*FuncCallStmt).Call
+	if len(call.Args) != 2 || call.Pos().line != 1 || call.End().line != 4 || call.End().column != 2 {
+		t.Fatal(call.Pos(), call.End())
+	}
+	if a := call.Args[1]; a.Pos().line != 3 || a.Pos().column != 3 || a.End().column != 4 {
+		t.Fatal(a.Pos(), a.End())
+	}
+
+	// 节点的End是最后一个token的end
+	as := b.Stmts[1].(*AssignStmt)
+	v := as.Values[0].(*BinOpExpr)
+	if v.Pos().column != 5 || v.End().column != 24 || v.Lhs.End().column != 16 || v.Rhs.Pos().column != 20 {
+		t.Fatal(v.End(), v.Lhs.End(), v.Rhs.Pos())
+	}
+	if k := v.Lhs.(*BinOpExpr).Lhs.(*IndexExpr); k.End().column != 11 || k.Key.End().column != 10 {
+		t.Fatal(k.End(), k.Key.End())
+	}
+	if as.Targets[0].End().column != 2 {
+		t.Fatal(as.Targets[0].End())
+	}
+
+	e, err := ParseExprString("function(a)\n  return (a)\nend")
+	if err != nil || e.End().line != 3 || e.End().column != 4 {
+		t.Fatal(e, err)
+	}
+}
+
+func TestIndexSugar(t *testing.T) {
+	// a.b 就是 a["b"]，两种写法的树一样
+	pairs := [][2]string{
+		{"a.b", `a["b"]`},
+		{"a.b.c", `a["b"]["c"]`},
+		{"a.b[1]", `a["b"][1]`},
+	}
+	for _, p := range pairs {
+		x, err1 := ParseExprString(p[0])
+		y, err2 := ParseExprString(p[1])
+		if err1 != nil || err2 != nil {
+			t.Fatal(err1, err2)
+		}
+
+		if sx, sy := sexpr(x), sexpr(y); sx != sy {
+			t.Errorf("%s: %s, %s: %s", p[0], sx, p[1], sy)
+		}
+	}
+
+	if e, _ := ParseExprString("a.b.c"); sexpr(e) != `(index (index a "b") "c")` {
+		t.Errorf("got %s", sexpr(e))
+	}
+
+	// 赋值目标也一样
+	s1, _ := ParseStatement(lex("a.b = 1"))
+	s2, _ := ParseStatement(lex(`a["b"] = 1`))
+	if x, y := sexpr(s1.(*AssignStmt).Targets[0]), sexpr(s2.(*AssignStmt).Targets[0]); x != y || x != `(index a "b")` {
+		t.Errorf("got %s, %s", x, y)
+	}
+}
+
+func TestAssignInCondition(t *testing.T) {
+	cases := map[string]int{
+		"if a = b then end":                 6,
+		"if x then elseif a.b = 1 then end": 22,
+		"while a = b do end":                9,
+		"repeat until a = b":                16,
+	}
+
+	for src, column := range cases {
+		_, err := ParseChunk(lex(src))
+		if err == nil || err.msg != "unexpected '=' in condition, did you mean '=='?" || err.pos.column != column {
+			t.Errorf("%s: got %v", src, err)
+		}
+	}
+
+	// until后面换行的赋值是下一条语句
+	if _, err := ParseChunk(lex("if a == b then end repeat until a\nb = 1")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSemicolon(t *testing.T) {
+	tokens, errs := ScanAll("a;b", "x")
+	if len(errs) != 0 || len(tokens) != 3 || tokens[1].typ != TSemicolon || tokens[1].typ.String() != ";" {
+		t.Fatal(tokens, errs)
+	}
+
+	// 空语句不进树
+	b, err := ParseChunk(lex(";;local a = 1; f();\nif a then ; end return a;"))
+	if err != nil || len(b.Stmts) != 4 {
+		t.Fatal(b, err)
+	}
+	if r, ok := b.Stmts[3].(*ReturnStmt); !ok || len(r.Values) != 1 {
+		t.Fatal(b.Stmts[3])
+	}
+	if b, err := ParseChunk(lex("return;")); err != nil || len(b.Stmts[0].(*ReturnStmt).Values) != 0 {
+		t.Fatal(b, err)
+	}
+	if _, err := ParseChunk(lex("return; x = 1")); err == nil || err.msg != "'<eof>' expected near 'x'" {
+		t.Fatalf("got %v", err)
+	}
+
+	// table里,和;可以混用，最后可以多一个分隔符
+	for src, n := range map[string]int{"{1; 2; 3}": 3, "{1, 2; 3}": 3, "{1, 2,}": 2, "{1;}": 1} {
+		e, err := ParseExprString(src)
+		if tb, ok := e.(*TableExpr); err != nil || !ok || len(tb.Fields) != n {
+			t.Errorf("%s: got %v %v", src, e, err)
+		}
+	}
+	for _, src := range []string{"{;}", "{1;;}", "{1,;2}"} {
+		if _, err := ParseExprString(src); err == nil {
+			t.Errorf("%s: want error", src)
+		}
+	}
+}
+
+func TestParseExprString(t *testing.T) {
+	e, err := ParseExprString("1 + 2 * 3")
+	if err != nil || sexpr(e) != "(+ 1 (* 2 3))" {
+		t.Fatal(e, err)
+	}
+
+	e, err = ParseExprString(`f(a, 1):m "x"`)
+	call, ok := e.(*FuncCallExpr)
+	if err != nil || !ok || call.Method != "m" || len(call.Args) != 1 {
+		t.Fatal(e, err)
+	}
+	if inner, ok := call.Fn.(*FuncCallExpr); !ok || len(inner.Args) != 2 || sexpr(inner.Fn) != "f" {
+		t.Fatal(call.Fn)
+	}
+
+	bad := map[string]string{
+		"1 + 2 x": "'<eof>' expected near 'x'",
+		"local x": "unexpected symbol near 'local'",
+		"":        "unexpected symbol near '<eof>'",
+	}
+	for src, msg := range bad {
+		if _, err := ParseExprString(src); err == nil || err.msg != msg {
+			t.Errorf("%q: got %v", src, err)
+		}
+	}
+}
+
+func TestTableConstructor(t *testing.T) {
+	e, err := ParseExprString("{}")
+	if tb, ok := e.(*TableExpr); err != nil || !ok || len(tb.Fields) != 0 || tb.End().column != 3 {
+		t.Fatal(e, err)
+	}
+
+	cases := map[string][]string{
+		"{1, 2, 3}":                          {"1", "2", "3"},
+		"{x = 1, y = 2}":                     {`"x"=1`, `"y"=2`},
+		"{1; x = a, [k .. 1] = 3, f(x), y;}": {"1", `"x"=a`, `(.. k 1)=3`, "(call f x)", "y"},
+		"{{}, {{}}}":                         {"*parser.TableExpr", "*parser.TableExpr"},
+	}
+	for src, want := range cases {
+		e, err := ParseExprString(src)
+		tb, ok := e.(*TableExpr)
+		if err != nil || !ok || len(tb.Fields) != len(want) {
+			t.Fatalf("%s: %v %v", src, e, err)
+		}
+
+		for i, f := range tb.Fields {
+			got := sexpr(f.Value)
+			if f.Key != nil {
+				got = sexpr(f.Key) + "=" + got
+			}
+			if got != want[i] {
+				t.Errorf("%s: field %d: got %s, want %s", src, i, got, want[i])
+			}
+		}
+	}
+
+	bad := map[string]string{
+		"{1 2}":  "'}' expected (to close '{' at line 1) near '2'",
+		"{1,,}":  "unexpected symbol near ','",
+		"{[1] }": "'=' expected near '}'",
+		"{x = }": "unexpected symbol near '}'",
+	}
+	for src, msg := range bad {
+		if _, err := ParseExprString(src); err == nil || err.msg != msg {
+			t.Errorf("%s: got %v", src, err)
+		}
+	}
+
+	b, err := ParseChunk(lex("f{1}\nlocal t = {a = 1; 2; [\"b c\"] = 3, [\"d\"] = 4}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := Print(b); out != "f({1})\nlocal t = {a = 1, 2, [\"b c\"] = 3, d = 4}\n" {
+		t.Errorf("got %q", out)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	for _, src := range []string{`require "mod"`, `require("mod")`, `require [[mod]]`, `require 'mod'`} {
+		e, err := ParseExprString(src)
+		if r, ok := e.(*RequireExpr); err != nil || !ok || r.Module != "mod" || r.End().column != len(src)+1 {
+			t.Errorf("%s: %v %v", src, e, err)
+		}
+	}
+
+	b, err := ParseChunk(lex("require \"a\"\nlocal m = require(\"b.c\")\nrequire(\"d\").init(1)\nx = require 'e'.f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.Stmts[0].(*RequireStmt); !ok {
+		t.Fatalf("got %T", b.Stmts[0])
+	}
+	if _, ok := b.Stmts[2].(*FuncCallStmt); !ok {
+		t.Fatalf("got %T", b.Stmts[2])
+	}
+	want := "require(\"a\")\nlocal m = require(\"b.c\")\nrequire(\"d\").init(1)\nx = require(\"e\").f\n"
+	if out := Print(b); out != want {
+		t.Errorf("got %q", out)
+	}
+
+	// 括号里可以是任意表达式
+	for src, want := range map[string]string{"require(p)": "p", `require(dir .. "/m")`: `(.. dir "/m")`} {
+		e, err := ParseExprString(src)
+		r, ok := e.(*RequireExpr)
+		if err != nil || !ok || r.Module != "" || r.Arg == nil || sexpr(r.Arg) != want {
+			t.Errorf("%s: %v %v", src, e, err)
+		}
+	}
+	// 不带参数时是普通的函数值
+	if e, err := ParseExprString(`pcall(require, "m")`); err != nil || sexpr(e) != `(call pcall require "m")` {
+		t.Errorf("got %v %v", e, err)
+	}
+
+	if out, err := Format("local rr = require(p)\n", "x"); err != nil || out != "local rr = require(p)\n" {
+		t.Errorf("got %q %v", out, err)
+	}
+
+	bad := map[string]string{
+		"require x":         "'=' expected near 'x'",
+		`require("a", "b")`: "')' expected (to close '(' at line 1) near ','",
+		`require "a" = 1`:   "unexpected symbol near '='",
+	}
+	for src, msg := range bad {
+		if _, err := ParseChunk(lex(src)); err == nil || err.msg != msg {
+			t.Errorf("%s: got %v", src, err)
+		}
+	}
+}
+
+func TestSuffixChain(t *testing.T) {
+	// 后缀从左往右结合
+	cases := map[string]string{
+		"f().x:g()[1]": `(index (call (index (call f) "x"):g) 1)`,
+		"a.b.c(1)(2)":  `(call (call (index (index a "b") "c") 1) 2)`,
+		`o:m "s" {1}`:  `(call (call o:m "s") *parser.TableExpr)`,
+		"(f)().x":      `(index (call (f)) "x")`,
+	}
+
+	for src, want := range cases {
+		e, err := ParseExprString(src)
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if got := sexpr(e); got != want {
+			t.Errorf("%s: got %s, want %s", src, got, want)
+		}
+	}
+
+	src := "return f().x:g()[1]\n"
+	if out, err := Format(src, "x"); err != nil || out != src {
+		t.Errorf("got %q %v", out, err)
+	}
+}
+
+func TestLogicalOperators(t *testing.T) {
+	cases := map[string]string{
+		"a and b or c":     "(or (and a b) c)",
+		"a or b and c":     "(or a (and b c))",
+		"a or b or c":      "(or (or a b) c)",
+		"not x == y":       "(== (not x) y)",
+		"not (x == y)":     "(not ((== x y)))",
+		"a < b and not c":  "(and (< a b) (not c))",
+		"not not a .. b":   "(.. (not (not a)) b)",
+		"x == 1 or #t > 2": "(or (== x 1) (> (# t) 2))",
+	}
+
+	for src, want := range cases {
+		e, err := ParseExprString(src)
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if got := sexpr(e); got != want {
+			t.Errorf("%s: got %s, want %s", src, got, want)
+		}
+	}
+
+	src := "x = not a == b and (c or d)\ny = not (a and b)\n"
+	if out, err := Format(src, "x"); err != nil || out != src {
+		t.Fatalf("%q %v", out, err)
+	}
+}
+
+func TestUnaryMinus(t *testing.T) {
+	cases := map[string]string{
+		"#list":   "(# list)",
+		"-a":      "(- a)",
+		"-2^2":    "(- (^ 2 2))",
+		"-a * b":  "(* (- a) b)",
+		"a - -b":  "(- a (- b))",
+		"- - a":   "(- (- a))",
+		"2^-3":    "(^ 2 (- 3))",
+		"-x .. y": "(.. (- x) y)",
+		"not -a":  "(not (- a))",
+		"-#t + 1": "(+ (- (# t)) 1)",
+	}
+
+	for src, want := range cases {
+		e, err := ParseExprString(src)
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if got := sexpr(e); got != want {
+			t.Errorf("%s: got %s, want %s", src, got, want)
+		}
+	}
+
+	if e, _ := ParseExprString("-x"); e.Pos().column != 1 || e.End().column != 3 {
+		t.Errorf("got %v %v", e.Pos(), e.End())
+	}
+
+	// - -a 不能打印成注释 --a
+	src := "x = -2 ^ 2\ny = (-2) ^ 2\nz = a - -b\nw = - -a\n"
+	if out, err := Format(src, "x"); err != nil || out != src {
+		t.Fatalf("%q %v", out, err)
+	}
+}
+
+func TestSliceNode(t *testing.T) {
+	l := lex("local f = function(a) return a end -- c")
+	b, err := ParseChunk(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn := b.Stmts[0].(*LocalStmt).Values[0]
+	if s, err := l.Slice(fn.Pos(), fn.End()); err != nil || s != "function(a) return a end" {
+		t.Fatalf("%q %v", s, err)
+	}
+}
@@ -0,0 +1,707 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const indentStr = "    "
+
+type printer struct {
+	sb       strings.Builder
+	indent   int
+	comments []Comment // 还没有输出的注释，按位置排序
+	l        *Lexer    // 格式化时用来取原文
+}
+
+// 把语法树重新输出成lua代码
+func Print(node Node) string {
+	p := printer{}
+
+	switch n := node.(type) {
+	case *Block:
+		p.block(n)
+	case Stmt:
+		p.stmt(n)
+	case Expr:
+		p.expr(n)
+	}
+
+	return p.sb.String()
+}
+
+// 格式化lua代码，注释会尽量保留在原来的语句前面或者同一行后面。
+// 表达式、名字列表和参数列表中间有注释时，这一段按原文输出。
+// 已知的限制：then/do前面和elseif后面的注释会移到这一行的末尾或者下一行
+func Format(src, fileName string) (string, *Error) {
+	l := InitLexerBytes([]byte(src), fileName)
+
+	b, err := ParseChunk(l)
+	if err != nil {
+		return "", err
+	}
+
+	p := printer{comments: l.Comments(), l: l}
+	p.block(b)
+	p.leadingComments(-1)
+
+	return p.sb.String(), nil
+}
+
+// 输出所有在offset之前开始的注释，每个注释单独一行，offset为-1时输出全部
+func (p *printer) leadingComments(offset int) {
+	for len(p.comments) > 0 && (offset < 0 || p.comments[0].pos.offset < offset) {
+		p.line(p.comments[0].text)
+		p.comments = p.comments[1:]
+	}
+}
+
+// 和end在同一行并且在limit之前的注释跟在后面，limit为-1时不限制
+func (p *printer) trailingComment(end Position, limit int) {
+	for len(p.comments) > 0 && p.comments[0].pos.line == end.line && p.comments[0].pos.offset >= end.offset &&
+		(limit < 0 || p.comments[0].pos.offset < limit) {
+		p.write(" ", p.comments[0].text)
+		p.comments = p.comments[1:]
+	}
+}
+
+// if a then -- c 这种跟在关键字后面的注释留在原来的行，end是关键字之前最后一个token的位置
+func (p *printer) headerComment(end Position, body *Block) {
+	limit := body.End().offset
+	if len(body.Stmts) > 0 {
+		limit = body.Stmts[0].Pos().offset
+	}
+
+	p.trailingComment(end, limit)
+	p.write("\n")
+}
+
+// [start, end)之间有没有还没输出的注释
+func (p *printer) commentIn(start, end int) bool {
+	for _, c := range p.comments {
+		if c.pos.offset >= end {
+			break
+		}
+		if c.pos.offset >= start {
+			return true
+		}
+	}
+
+	return false
+}
+
+// [start, end)里在children之外有注释时，按原文输出这一段并返回true
+func (p *printer) verbatim(start, end Position, children ...Expr) bool {
+	if p.l == nil {
+		return false
+	}
+
+	starts := make([]int, len(children))
+	ends := make([]Position, len(children))
+	for i, c := range children {
+		starts[i], ends[i] = c.Pos().offset, c.End()
+	}
+	if !p.commentBetween(start.offset, starts, ends, end.offset) {
+		return false
+	}
+
+	src, err := p.l.Slice(start, end)
+	if err != nil {
+		return false
+	}
+	p.write(src)
+
+	// 原文里的注释已经输出了
+	rest := p.comments[:0]
+	for _, c := range p.comments {
+		if c.pos.offset < start.offset || c.pos.offset >= end.offset {
+			rest = append(rest, c)
+		}
+	}
+	p.comments = rest
+
+	return true
+}
+
+func (p *printer) write(strs ...string) {
+	for _, s := range strs {
+		p.sb.WriteString(s)
+	}
+}
+
+func (p *printer) line(strs ...string) {
+	p.write(strings.Repeat(indentStr, p.indent))
+	p.write(strs...)
+	p.write("\n")
+}
+
+func (p *printer) block(b *Block) {
+	for i, s := range b.Stmts {
+		p.leadingComments(s.Pos().offset)
+		p.write(strings.Repeat(indentStr, p.indent))
+		if i > 0 && startsWithParen(s) {
+			p.write(";") // 否则会被当成上一条语句的调用
+		}
+		p.stmt(s)
+
+		// 只收下一个token之前的注释，end后面的注释属于外面的语句
+		limit := b.End().offset
+		if i < len(b.Stmts)-1 {
+			limit = b.Stmts[i+1].Pos().offset
+		}
+		p.trailingComment(s.End(), limit)
+		p.write("\n")
+	}
+
+	// block末尾，结束token之前的注释
+	p.leadingComments(b.End().offset)
+}
+
+func (p *printer) body(b *Block) {
+	p.indent++
+	p.block(b)
+	p.indent--
+}
+
+func (p *printer) stmt(s Stmt) {
+	if children, ok := stmtExprs(s); ok && p.verbatim(s.Pos(), s.End(), children...) {
+		return
+	}
+
+	switch s := s.(type) {
+	case *LocalStmt:
+		p.write("local ", strings.Join(s.Names, ", "))
+		if len(s.Values) > 0 {
+			p.write(" = ")
+			p.exprList(s.Values)
+		}
+	case *AssignStmt:
+		p.exprList(s.Targets)
+		p.write(" = ")
+		p.exprList(s.Values)
+	case *CompoundAssignStmt:
+		p.expr(s.Target)
+		p.write(" ", s.Op.String(), "= ")
+		p.expr(s.Value)
+	case *FuncCallStmt:
+		p.expr(s.Call)
+	case *RequireStmt:
+		p.expr(s.Require)
+	case *IfStmt:
+		for i, branch := range s.Branches {
+			if i > 0 {
+				p.write(strings.Repeat(indentStr, p.indent), "elseif ")
+				p.expr(branch.Cond)
+			} else if !p.verbatim(s.Pos(), branch.Cond.End(), branch.Cond) {
+				p.write("if ")
+				p.expr(branch.Cond)
+			}
+			p.write(" then")
+			p.headerComment(branch.Cond.End(), branch.Body)
+			p.body(branch.Body)
+		}
+
+		if s.Else != nil {
+			// 最后一个分支的block结束在else上
+			p.write(strings.Repeat(indentStr, p.indent), "else")
+			p.headerComment(s.Branches[len(s.Branches)-1].Body.End(), s.Else)
+			p.body(s.Else)
+		}
+		p.write(strings.Repeat(indentStr, p.indent), "end")
+	case *DoStmt:
+		p.write("do")
+		p.headerComment(s.Pos(), s.Body)
+		p.body(s.Body)
+		p.write(strings.Repeat(indentStr, p.indent), "end")
+	case *WhileStmt:
+		if !p.verbatim(s.Pos(), s.Cond.End(), s.Cond) {
+			p.write("while ")
+			p.expr(s.Cond)
+		}
+		p.write(" do")
+		p.headerComment(s.Cond.End(), s.Body)
+		p.body(s.Body)
+		p.write(strings.Repeat(indentStr, p.indent), "end")
+	case *RepeatStmt:
+		p.write("repeat")
+		p.headerComment(s.Pos(), s.Body)
+		p.body(s.Body)
+		p.write(strings.Repeat(indentStr, p.indent), "until ")
+		p.expr(s.Cond)
+	case *ForNumStmt:
+		header := []Expr{s.Start, s.Stop}
+		if s.Step != nil {
+			header = append(header, s.Step)
+		}
+		last := header[len(header)-1]
+		if !p.verbatim(s.Pos(), last.End(), header...) {
+			p.write("for ", s.Var, " = ")
+			p.exprList(header)
+		}
+		p.write(" do")
+		p.headerComment(last.End(), s.Body)
+		p.body(s.Body)
+		p.write(strings.Repeat(indentStr, p.indent), "end")
+	case *ForInStmt:
+		if !p.verbatim(s.Pos(), s.Exprs[len(s.Exprs)-1].End(), s.Exprs...) {
+			p.write("for ", strings.Join(s.Names, ", "), " in ")
+			p.exprList(s.Exprs)
+		}
+		p.write(" do")
+		p.headerComment(s.Exprs[len(s.Exprs)-1].End(), s.Body)
+		p.body(s.Body)
+		p.write(strings.Repeat(indentStr, p.indent), "end")
+	case *BreakStmt:
+		p.write("break")
+	case *GotoStmt:
+		p.write("goto ", s.Label)
+	case *LabelStmt:
+		p.write("::", s.Name, "::")
+	case *FunctionStmt:
+		if !p.verbatim(s.Pos(), s.Func.paramsEnd) {
+			p.write("function ")
+			if s.IsMethod {
+				// 最后一级用:，并且去掉隐式的self
+				ix := s.Name.(*IndexExpr)
+				p.expr(ix.Obj)
+				p.write(":", ix.Key.(*StringExpr).Value)
+				p.params(s.Func, s.Func.Params[1:])
+			} else {
+				p.expr(s.Name)
+				p.params(s.Func, s.Func.Params)
+			}
+		}
+		p.funcBody(s.Func)
+	case *LocalFunctionStmt:
+		if !p.verbatim(s.Pos(), s.Func.paramsEnd) {
+			p.write("local function ", s.Name)
+			p.params(s.Func, s.Func.Params)
+		}
+		p.funcBody(s.Func)
+	case *ReturnStmt:
+		p.write("return")
+		if len(s.Values) > 0 {
+			p.write(" ")
+			p.exprList(s.Values)
+		}
+	}
+}
+
+// 不含block的语句的子表达式，按位置排序
+func stmtExprs(s Stmt) ([]Expr, bool) {
+	switch s := s.(type) {
+	case *LocalStmt:
+		return s.Values, true
+	case *AssignStmt:
+		return append(s.Targets[:len(s.Targets):len(s.Targets)], s.Values...), true
+	case *CompoundAssignStmt:
+		return []Expr{s.Target, s.Value}, true
+	case *FuncCallStmt:
+		return []Expr{s.Call}, true
+	case *RequireStmt:
+		return []Expr{s.Require}, true
+	case *ReturnStmt:
+		return s.Values, true
+	case *BreakStmt, *GotoStmt, *LabelStmt:
+		return nil, true
+	}
+
+	return nil, false
+}
+
+func (p *printer) params(f *FunctionExpr, params []string) {
+	if f.IsVararg {
+		params = append(params[:len(params):len(params)], "...")
+	}
+
+	p.write("(", strings.Join(params, ", "), ")")
+}
+
+func (p *printer) funcBody(f *FunctionExpr) {
+	p.headerComment(f.paramsEnd, f.Body)
+	p.body(f.Body)
+	p.write(strings.Repeat(indentStr, p.indent), "end")
+}
+
+func (p *printer) exprList(list []Expr) {
+	for i, e := range list {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.expr(e)
+	}
+}
+
+func (p *printer) expr(e Expr) {
+	if children, ok := operands(e); ok && p.verbatim(e.Pos(), e.End(), children...) {
+		return
+	}
+
+	switch e := e.(type) {
+	case *NilExpr:
+		p.write("nil")
+	case *BoolExpr:
+		p.write(strconv.FormatBool(e.Value))
+	case *NumberExpr:
+		p.write(formatNumber(e))
+	case *StringExpr:
+		p.write(quoteString(e.Value))
+	case *VarargExpr:
+		p.write("...")
+	case *NameExpr:
+		p.write(e.Name)
+	case *ParenExpr:
+		p.write("(")
+		p.expr(e.Inner)
+		p.write(")")
+	case *IndexExpr:
+		p.prefixExpr(e.Obj)
+		if key, ok := e.Key.(*StringExpr); ok && isName(key.Value) {
+			p.write(".", key.Value)
+		} else {
+			p.write("[")
+			p.expr(e.Key)
+			p.write("]")
+		}
+	case *FuncCallExpr:
+		p.prefixExpr(e.Fn)
+		if e.Method != "" {
+			p.write(":", e.Method)
+		}
+		p.callArgs(e)
+	case *TableExpr:
+		p.table(e)
+	case *RequireExpr:
+		if e.Arg != nil {
+			p.write("require(")
+			p.expr(e.Arg)
+			p.write(")")
+		} else {
+			p.write("require(", quoteString(e.Module), ")")
+		}
+	case *FunctionExpr:
+		if !p.verbatim(e.Pos(), e.paramsEnd) {
+			p.write("function")
+			p.params(e, e.Params)
+		}
+		p.funcBody(e)
+	case *UnOpExpr:
+		p.write(e.Op.String())
+		if e.Op == TNot {
+			p.write(" ")
+		} else if e.Op == TMinus && startsWithMinus(e.Operand) {
+			p.write(" ") // 避免输出成注释--
+		}
+		p.subExpr(e.Operand, unaryPriority, false)
+	case *BinOpExpr:
+		priority := binaryPriority[e.Op]
+		p.subExpr(e.Lhs, priority[0], priority[0] > priority[1])
+		p.write(" ", e.Op.String(), " ")
+		if _, ok := e.Rhs.(*UnOpExpr); ok || startsWithMinus(e.Rhs) {
+			p.expr(e.Rhs) // 右边的一元运算不受优先级影响
+		} else {
+			p.subExpr(e.Rhs, priority[1], priority[0] <= priority[1])
+		}
+	}
+}
+
+// 运算符、索引和括号表达式的子表达式，调用参数和table自己处理注释
+func operands(e Expr) ([]Expr, bool) {
+	switch e := e.(type) {
+	case *BinOpExpr:
+		return []Expr{e.Lhs, e.Rhs}, true
+	case *UnOpExpr:
+		return []Expr{e.Operand}, true
+	case *IndexExpr:
+		return []Expr{e.Obj, e.Key}, true
+	case *ParenExpr:
+		return []Expr{e.Inner}, true
+	case *RequireExpr:
+		if e.Arg != nil {
+			return []Expr{e.Arg}, true
+		}
+		return nil, true
+	}
+
+	return nil, false
+}
+
+// 参数之间有注释时每个参数一行，注释留在原来的参数后面
+func (p *printer) callArgs(e *FuncCallExpr) {
+	starts := make([]int, len(e.Args))
+	ends := make([]Position, len(e.Args))
+	for i, arg := range e.Args {
+		starts[i], ends[i] = arg.Pos().offset, arg.End()
+	}
+
+	if !p.commentBetween(e.Fn.End().offset, starts, ends, e.End().offset) {
+		p.write("(")
+		p.exprList(e.Args)
+		p.write(")")
+		return
+	}
+
+	p.write("(")
+	p.trailingComment(e.Fn.End(), firstOr(starts, e.End().offset))
+	p.write("\n")
+	p.indent++
+	for i, arg := range e.Args {
+		p.leadingComments(starts[i])
+		p.write(strings.Repeat(indentStr, p.indent))
+		p.expr(arg)
+
+		limit := e.End().offset
+		if i < len(e.Args)-1 {
+			p.write(",")
+			limit = starts[i+1]
+		}
+		p.trailingComment(ends[i], limit)
+		p.write("\n")
+	}
+	p.leadingComments(e.End().offset)
+	p.indent--
+	p.write(strings.Repeat(indentStr, p.indent), ")")
+}
+
+// 和callArgs一样，字段之间有注释时每个字段一行
+func (p *printer) table(e *TableExpr) {
+	starts := make([]int, len(e.Fields))
+	ends := make([]Position, len(e.Fields))
+	for i, f := range e.Fields {
+		starts[i], ends[i] = f.Value.Pos().offset, f.Value.End()
+		if f.Key != nil {
+			starts[i] = f.Key.Pos().offset
+		}
+	}
+
+	if !p.commentBetween(e.Pos().offset, starts, ends, e.End().offset) {
+		p.write("{")
+		for i, f := range e.Fields {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.field(f)
+		}
+		p.write("}")
+		return
+	}
+
+	p.write("{")
+	p.trailingComment(e.Pos(), firstOr(starts, e.End().offset))
+	p.write("\n")
+	p.indent++
+	for i, f := range e.Fields {
+		p.leadingComments(starts[i])
+		p.write(strings.Repeat(indentStr, p.indent))
+		p.field(f)
+		p.write(",")
+
+		limit := e.End().offset
+		if i < len(e.Fields)-1 {
+			limit = starts[i+1]
+		}
+		p.trailingComment(ends[i], limit)
+		p.write("\n")
+	}
+	p.leadingComments(e.End().offset)
+	p.indent--
+	p.write(strings.Repeat(indentStr, p.indent), "}")
+}
+
+func (p *printer) field(f *TableField) {
+	if key, ok := f.Key.(*StringExpr); ok && isName(key.Value) {
+		p.write(key.Value, " = ")
+	} else if f.Key != nil {
+		p.write("[")
+		p.expr(f.Key)
+		p.write("] = ")
+	}
+	p.expr(f.Value)
+}
+
+func firstOr(starts []int, close int) int {
+	if len(starts) > 0 {
+		return starts[0]
+	}
+
+	return close
+}
+
+// 从open到close之间，除了各个元素[starts[i], ends[i])内部以外有没有注释
+func (p *printer) commentBetween(open int, starts []int, ends []Position, close int) bool {
+	for i := range starts {
+		if p.commentIn(open, starts[i]) {
+			return true
+		}
+		open = ends[i].offset
+	}
+
+	return p.commentIn(open, close)
+}
+
+// 只有在优先级不够时才加括号，strict表示优先级相等也要加
+func (p *printer) subExpr(e Expr, limit int, strict bool) {
+	var priority int
+
+	switch e := e.(type) {
+	case *BinOpExpr:
+		priority = binaryPriority[e.Op][0]
+	case *UnOpExpr:
+		priority = unaryPriority
+	case *NumberExpr:
+		if !startsWithMinus(e) {
+			p.expr(e)
+			return
+		}
+		priority = unaryPriority
+	default:
+		p.expr(e)
+		return
+	}
+
+	if priority < limit || strict && priority == limit {
+		p.write("(")
+		p.expr(e)
+		p.write(")")
+	} else {
+		p.expr(e)
+	}
+}
+
+// 调用和索引的对象必须是名字、调用、索引或者括号表达式
+func (p *printer) prefixExpr(e Expr) {
+	switch e.(type) {
+	case *NameExpr, *IndexExpr, *FuncCallExpr, *ParenExpr, *RequireExpr:
+		p.expr(e)
+	default:
+		p.write("(")
+		p.expr(e)
+		p.write(")")
+	}
+}
+
+// 语句输出之后是不是以(开头
+func startsWithParen(s Stmt) bool {
+	var e Expr
+	switch s := s.(type) {
+	case *FuncCallStmt:
+		e = s.Call
+	case *AssignStmt:
+		e = s.Targets[0]
+	case *CompoundAssignStmt:
+		e = s.Target
+	default:
+		return false
+	}
+
+	for {
+		switch n := e.(type) {
+		case *FuncCallExpr:
+			e = n.Fn
+		case *IndexExpr:
+			e = n.Obj
+		case *NameExpr, *RequireExpr:
+			return false
+		default:
+			// 括号表达式，或者prefixExpr会加上括号的表达式
+			return true
+		}
+	}
+}
+
+func startsWithMinus(e Expr) bool {
+	switch e := e.(type) {
+	case *UnOpExpr:
+		return e.Op == TMinus
+	case *NumberExpr:
+		return strings.HasPrefix(formatNumber(e), "-")
+	}
+
+	return false
+}
+
+func formatNumber(e *NumberExpr) string {
+	if e.IsInt {
+		return strconv.FormatInt(e.Int, 10)
+	}
+
+	// lua没有inf和nan的字面量
+	switch v := e.Value; {
+	case math.IsInf(v, 1):
+		return "1e999"
+	case math.IsInf(v, -1):
+		return "-1e999"
+	case math.IsNaN(v):
+		return "(0 / 0)"
+	}
+
+	s := strconv.FormatFloat(e.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".en") {
+		s += ".0"
+	}
+
+	return s
+}
+
+func quoteString(s string) string {
+	var sb strings.Builder
+
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\a':
+			sb.WriteString(`\a`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\v':
+			sb.WriteString(`\v`)
+		default:
+			if c >= 0x20 && c != 0x7f {
+				sb.WriteByte(c)
+				break
+			}
+
+			// 其他控制字符用\ddd，后面跟着数字时要写满三位
+			if i+1 < len(s) && isDigit(int(s[i+1])) {
+				fmt.Fprintf(&sb, "\\%03d", c)
+			} else {
+				fmt.Fprintf(&sb, "\\%d", c)
+			}
+		}
+	}
+	sb.WriteByte('"')
+
+	return sb.String()
+}
+
+func isName(s string) bool {
+	if s == "" || isDigit(int(s[0])) {
+		return false
+	}
+
+	if _, ok := keywordsStr2Token[s]; ok {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := int(s[i])
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || isDigit(c)) {
+			return false
+		}
+	}
+
+	return true
+}
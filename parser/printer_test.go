@@ -0,0 +1,233 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 这些文件本身不能被解析
+var unparsableFiles = map[string]string{
+	"all.lua":  "#开头的第一行",
+	"main.lua": "#开头的第一行",
+}
+
+func TestPrintRoundTripFiles(t *testing.T) {
+	files, err := filepath.Glob("../_lua5.1-tests/*.lua")
+	if err != nil || len(files) == 0 {
+		t.Fatal("no test files", err)
+	}
+
+	for _, f := range files {
+		src, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, perr := ParseChunk(InitLexerBytes(src, f))
+		if _, ok := unparsableFiles[filepath.Base(f)]; ok {
+			if perr == nil {
+				t.Errorf("%s: expected a parse error", f)
+			}
+			continue
+		}
+		if perr != nil {
+			t.Errorf("%s: %s", f, perr)
+			continue
+		}
+
+		out := Print(b)
+		b2, perr := ParseChunk(InitLexerBytes([]byte(out), f))
+		if perr != nil {
+			t.Errorf("%s: reparse: %s", f, perr)
+			continue
+		}
+		if out2 := Print(b2); out2 != out {
+			t.Errorf("%s: output changed after reparse", f)
+		}
+	}
+}
+
+func TestPrintDo(t *testing.T) {
+	b, err := ParseChunk(InitLexerBytes([]byte("do local x = 1 do end end"), "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "do\n    local x = 1\n    do\n    end\nend\n"
+	if out := Print(b); out != want {
+		t.Fatalf("got %q, want %q", out, want)
+	}
+}
+
+func TestPrintNumbers(t *testing.T) {
+	cases := map[string]string{
+		"x = 9223372036854775807": "x = 9223372036854775807\n",
+		"x = 0x7fffffffffffffff":  "x = 9223372036854775807\n",
+		"x = 9007199254740993":    "x = 9007199254740993\n",
+		"x = 1e999, -1e999":       "x = 1e999, -1e999\n",
+		"x = 2.0, 1e100":          "x = 2.0, 1e+100\n",
+	}
+
+	for src, want := range cases {
+		b, err := ParseChunk(lex(src))
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if out := Print(b); out != want {
+			t.Errorf("%s: got %q", src, out)
+		}
+	}
+}
+
+func TestPrintGoto(t *testing.T) {
+	out, err := Format("goto done\n::done::\n", "x")
+	if err != nil || out != "goto done\n::done::\n" {
+		t.Fatalf("%q %v", out, err)
+	}
+}
+
+func TestPrintBitwise(t *testing.T) {
+	for _, src := range []string{"x = ~a", "x = ~a & b", "x = a ~ ~b", "x = ~(a | b)", "x = a << 1 >> 2"} {
+		b, err := ParseChunk(lex(src))
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		if out := Print(b); out != src+"\n" {
+			t.Errorf("%s: got %q", src, out)
+		}
+	}
+}
+
+const printSrc = `local a, b = 1, 2.5
+local function f(x, ...)
+    if x then
+        return ...
+    elseif x == 1 then
+        x = x .. "a\"b"
+    else
+        while a < b do
+            a = (a + 1) * 2
+            break
+        end
+    end
+    return
+end
+function t.m:n(y)
+    repeat
+        y = y - 1
+    until y
+end
+for i = 1, 10, 2 do
+    print(i, t[i], t.x, obj:m("s"))
+end
+for k, v in pairs(t) do
+end
+x = function()
+end
+y = 2 ^ (3 ^ 4) - (1 - 2) .. (a .. b)
+`
+
+func tokenTypes(t *testing.T, src string) []string {
+	tokens, errs := ScanAll(src, "x")
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	var out []string
+	for _, tk := range tokens {
+		out = append(out, tk.String())
+	}
+	return out
+}
+
+func TestPrintRoundTrip(t *testing.T) {
+	b, err := ParseChunk(lex(printSrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := Print(b)
+	if out != printSrc {
+		t.Fatalf("got\n%s", out)
+	}
+
+	b2, err := ParseChunk(lex(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out2 := Print(b2); out2 != out {
+		t.Fatalf("output changed after reparse:\n%s", out2)
+	}
+
+	// (开头的语句前面要加;，不然会和上一条语句连起来
+	for _, src := range []string{"x = y; (f)()", "f(); (g or h).x = 1", "a = b\n;(t)[1] = 2", "local a = b;(f)():m()", "x = 1 ;(a).b ..= c"} {
+		b, err := ParseChunk(lex(src))
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+
+		out := Print(b)
+		b2, err := ParseChunk(lex(out))
+		if err != nil {
+			t.Fatalf("%s: reparse %q: %s", src, out, err)
+		}
+		if len(b2.Stmts) != len(b.Stmts) || Print(b2) != out {
+			t.Errorf("%s: got %q", src, out)
+		}
+	}
+	if b, _ := ParseChunk(lex("(f)() x = y; (f)()")); Print(b) != "(f)()\nx = y\n;(f)()\n" {
+		t.Errorf("got %q", Print(b))
+	}
+
+	// 打印结果和原来的token序列一致
+	src := "local a,b=1,2.5 x=-a^2 .. f({1,k=2,[3]=4})(...) if a then return end"
+	b, err = ParseChunk(lex(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, got := tokenTypes(t, src), tokenTypes(t, Print(b))
+	if len(want) != len(got) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		// 只比较类型和值，位置会变
+		if w, g := want[i][:strings.IndexByte(want[i], '@')], got[i][:strings.IndexByte(got[i], '@')]; w != g {
+			t.Errorf("%d: got %s, want %s", i, g, w)
+		}
+	}
+}
+
+func TestPrintParens(t *testing.T) {
+	// 手工构造的树没有括号节点，打印时按优先级补上
+	e := &BinOpExpr{Op: TCaret, Lhs: &BinOpExpr{Op: TCaret, Lhs: &NameExpr{Name: "a"}, Rhs: &NameExpr{Name: "b"}}, Rhs: &NumberExpr{Value: -2, IsInt: true, Int: -2}}
+	if s := Print(e); s != "(a ^ b) ^ -2" {
+		t.Fatalf("got %s", s)
+	}
+}
+
+func TestPrintControlBytes(t *testing.T) {
+	cases := map[string]string{
+		"a\x00b\x01":   `"a\0b\1"`,
+		"\x001":        `"\0001"`,
+		"\x1f\x7f9":    `"\31\1279"`,
+		"\x0e\x7fx":    `"\14\127x"`,
+		"é\t\n":        `"é\t\n"`,
+		"\x00\x00\x00": `"\0\0\0"`,
+	}
+
+	for v, want := range cases {
+		out := Print(&StringExpr{Value: v})
+		if out != want {
+			t.Errorf("%q: got %s, want %s", v, out, want)
+		}
+
+		// 扫描回来还是原来的值
+		if tk, err := lex(out).Scan(); err != nil || tk.val != v {
+			t.Errorf("%s: scanned %v %v", out, tk, err)
+		}
+	}
+}
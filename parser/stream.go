@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"context"
+	"io"
+)
+
+// 读出r的全部内容，ctx被取消时不再等待，直接返回ctx的错误。
+// 阻塞在Read里的goroutine没法打断，它会在Read返回之后退出
+func readAll(ctx context.Context, r io.Reader, fileName string) ([]byte, *Error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		data, err := io.ReadAll(r)
+		done <- result{data, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, &Error{pos: Position{fileName: fileName}, msg: res.err.Error()}
+		}
+		return res.data, nil
+	case <-ctx.Done():
+		return nil, &Error{pos: Position{fileName: fileName}, msg: ctx.Err().Error()}
+	}
+}
+
+// 在goroutine里扫描r，token依次发送到第一个channel。
+// 会先把r全部读出来再开始扫描，读取时ctx被取消也会停止。
+// 遇到错误或者ctx被取消时，把错误发送到第二个channel后停止；两个channel最后都会被关闭
+func TokenStream(ctx context.Context, r io.Reader, fileName string) (<-chan Token, <-chan *Error) {
+	tokens := make(chan Token)
+	errs := make(chan *Error, 1)
+
+	go func() {
+		defer close(tokens)
+		defer close(errs)
+
+		src, err := readAll(ctx, r, fileName)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		l := InitLexerBytes(src, fileName)
+		for {
+			t, err := l.Scan()
+			if err != nil {
+				if !err.eof {
+					errs <- err
+				}
+				return
+			}
+
+			select {
+			case tokens <- *t:
+			case <-ctx.Done():
+				errs <- &Error{pos: t.pos, msg: ctx.Err().Error()}
+				return
+			}
+		}
+	}()
+
+	return tokens, errs
+}
+
+// 每扫描这么多个token检查一次ctx
+const ctxCheckInterval = 256
+
+// 扫描全部token，ctx被取消时提前返回已经扫描的token和ctx的错误。
+// 和TokenStream一样会先把r全部读出来
+func TokenizeContext(ctx context.Context, r io.Reader, fileName string) ([]Token, *Error) {
+	src, err := readAll(ctx, r, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	l := InitLexerBytes(src, fileName)
+
+	var tokens []Token
+	for {
+		if len(tokens)%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return tokens, &Error{pos: l.pos, msg: ctx.Err().Error()}
+		}
+
+		t, err := l.Scan()
+		if err != nil {
+			if err.eof {
+				return tokens, nil
+			}
+			return tokens, err
+		}
+		tokens = append(tokens, *t)
+	}
+}
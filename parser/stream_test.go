@@ -0,0 +1,108 @@
+package parser
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenStream(t *testing.T) {
+	tokens, errs := TokenStream(context.Background(), strings.NewReader("local a = 1 + 2"), "x")
+	var got []TokenType
+	for tk := range tokens {
+		got = append(got, tk.typ)
+	}
+	if err := <-errs; err != nil || len(got) != 6 || got[0] != TLocal || got[5] != TNumber {
+		t.Fatal(got, err)
+	}
+
+	tokens, errs = TokenStream(context.Background(), strings.NewReader("a $"), "x")
+	n := 0
+	for range tokens {
+		n++
+	}
+	if err := <-errs; n != 1 || err == nil || err.msg != "unknown token $" {
+		t.Fatal(n, err)
+	}
+
+	// 取消之后goroutine要退出并关闭两个channel
+	ctx, cancel := context.WithCancel(context.Background())
+	tokens, errs = TokenStream(ctx, strings.NewReader(strings.Repeat("a ", 1000)), "x")
+	<-tokens
+	cancel()
+	select {
+	case err := <-errs:
+		if err == nil || err.msg != context.Canceled.Error() {
+			t.Fatalf("got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream not stopped after cancel")
+	}
+	for range tokens {
+	}
+}
+
+func TestTokenizeContext(t *testing.T) {
+	tokens, err := TokenizeContext(context.Background(), strings.NewReader("a = 1"), "x")
+	if err != nil || len(tokens) != 3 {
+		t.Fatal(tokens, err)
+	}
+
+	tokens, err = TokenizeContext(context.Background(), strings.NewReader("a $ b"), "x")
+	if err == nil || err.msg != "unknown token $" || len(tokens) != 1 {
+		t.Fatal(tokens, err)
+	}
+
+	// 已经取消的ctx在扫描第一个token之前就返回
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tokens, err = TokenizeContext(ctx, strings.NewReader(strings.Repeat("a ", 10000)), "x")
+	if err == nil || err.msg != context.Canceled.Error() || len(tokens) != 0 {
+		t.Fatal(len(tokens), err)
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	if _, err := TokenizeContext(ctx, strings.NewReader("a"), "x"); err == nil || err.msg != context.DeadlineExceeded.Error() {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// 读取阻塞的时候取消也要及时返回
+func TestCancelWhileReading(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tokens, errs := TokenStream(ctx, r, "x")
+	time.AfterFunc(10*time.Millisecond, cancel)
+	select {
+	case err := <-errs:
+		if err == nil || err.msg != context.Canceled.Error() {
+			t.Fatalf("got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream not stopped after cancel")
+	}
+	if _, ok := <-tokens; ok {
+		t.Fatal("tokens not closed")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan *Error, 1)
+	go func() {
+		_, err := TokenizeContext(ctx, r, "x")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || err.msg != context.DeadlineExceeded.Error() {
+			t.Fatalf("got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TokenizeContext not stopped after timeout")
+	}
+}
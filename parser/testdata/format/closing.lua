@@ -0,0 +1,10 @@
+if not ok then return end -- bail
+do x() end -- c
+repeat x() until a -- t
+while a do f() end -- w
+for i = 1, 2 do g(i) end -- loop
+local function h() return 1 end -- fn
+if a then b() else c() end -- else
+x = 1 y = 2 -- y
+function m() if a then return end -- inner
+end -- outer
@@ -0,0 +1,28 @@
+x = a + -- c
+  b
+local x --[[c]] = 1
+function f(a, -- p
+  b)
+  return a
+end
+local function g(--[[none]]) end
+t.k = function(x --[[x]], y) return x end
+y = t[ -- key
+  1]
+z = -- value
+  (a --[[in]] + b) * c
+if a and -- both
+  b then
+  f()
+end
+while --[[w]] a do end
+for i = 1, -- stop
+  10 do end
+for k, v in -- iter
+  pairs(t) do end
+-- 已知限制：then前面和elseif后面的注释会换位置
+if a -- before then
+then x() elseif -- after elseif
+  b then end
+return -- r
+  x
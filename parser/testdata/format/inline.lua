@@ -0,0 +1,41 @@
+local t = {1, -- one
+  2, --[[ two ]] 3,
+  -- before x
+  x = 4 -- four
+}
+f(a, -- c
+  b)
+g( -- open
+  "s"
+  -- before close
+)
+local short = {1, 2, f(3)} -- whole line
+if a then -- c
+  x = 1
+elseif b then -- d
+  x = 2
+else -- e
+  x = 3
+end
+while a do -- loop
+end
+for i = 1, 10 do -- count
+  print(i)
+end
+for k, v in pairs(t) do -- each
+end
+repeat -- r
+until a
+do -- block
+  local y = 1
+end
+local function g() -- fn
+  return {
+    -- only a comment
+  }
+end
+h(function() -- callback
+  return 1
+end, 2)
+local u = { -- open
+  1 }
@@ -0,0 +1,13 @@
+-- header
+local a = 1   -- one
+-- before b
+local b =
+ 2
+function f()
+  -- inside
+  return a --[[ ret ]]
+  -- tail of body
+end -- after end
+--[==[ long
+comment ]==]
+x = 1
@@ -0,0 +1,92 @@
+package parser
+
+// 先序遍历语法树，visit返回false时不再进入这个节点的子节点
+func Walk(node Node, visit func(Node) bool) {
+	if !visit(node) {
+		return
+	}
+
+	switch n := node.(type) {
+	case *ParenExpr:
+		Walk(n.Inner, visit)
+	case *BinOpExpr:
+		Walk(n.Lhs, visit)
+		Walk(n.Rhs, visit)
+	case *UnOpExpr:
+		Walk(n.Operand, visit)
+	case *IndexExpr:
+		Walk(n.Obj, visit)
+		Walk(n.Key, visit)
+	case *TableExpr:
+		for _, f := range n.Fields {
+			if f.Key != nil {
+				Walk(f.Key, visit)
+			}
+			Walk(f.Value, visit)
+		}
+	case *RequireExpr:
+		if n.Arg != nil {
+			Walk(n.Arg, visit)
+		}
+	case *FunctionExpr:
+		Walk(n.Body, visit)
+	case *FuncCallExpr:
+		Walk(n.Fn, visit)
+		walkList(n.Args, visit)
+	case *Block:
+		for _, s := range n.Stmts {
+			Walk(s, visit)
+		}
+	case *CompoundAssignStmt:
+		Walk(n.Target, visit)
+		Walk(n.Value, visit)
+	case *LocalStmt:
+		walkList(n.Values, visit)
+	case *AssignStmt:
+		walkList(n.Targets, visit)
+		walkList(n.Values, visit)
+	case *IfStmt:
+		for _, b := range n.Branches {
+			Walk(b.Cond, visit)
+			Walk(b.Body, visit)
+		}
+		if n.Else != nil {
+			Walk(n.Else, visit)
+		}
+	case *DoStmt:
+		Walk(n.Body, visit)
+	case *WhileStmt:
+		Walk(n.Cond, visit)
+		Walk(n.Body, visit)
+	case *RepeatStmt:
+		Walk(n.Body, visit)
+		Walk(n.Cond, visit)
+	case *ForNumStmt:
+		Walk(n.Start, visit)
+		Walk(n.Stop, visit)
+		if n.Step != nil {
+			Walk(n.Step, visit)
+		}
+		Walk(n.Body, visit)
+	case *ForInStmt:
+		walkList(n.Exprs, visit)
+		Walk(n.Body, visit)
+	case *FuncCallStmt:
+		Walk(n.Call, visit)
+	case *RequireStmt:
+		Walk(n.Require, visit)
+	case *FunctionStmt:
+		Walk(n.Name, visit)
+		Walk(n.Func, visit)
+	case *LocalFunctionStmt:
+		Walk(n.Func, visit)
+	case *ReturnStmt:
+		walkList(n.Values, visit)
+	}
+}
+
+func walkList(list []Expr, visit func(Node) bool) {
+	for _, e := range list {
+		Walk(e, visit)
+	}
+}
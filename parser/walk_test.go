@@ -0,0 +1,48 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func walkOrder(n Node, visit func(Node) bool) string {
+	var kinds []string
+	Walk(n, func(n Node) bool {
+		kinds = append(kinds, strings.TrimPrefix(fmt.Sprintf("%T", n), "*parser."))
+		return visit(n)
+	})
+	return strings.Join(kinds, " ")
+}
+
+func TestWalk(t *testing.T) {
+	b, err := ParseChunk(lex("if a > 1 then f(a, {x = 2}) elseif b then return else local c = -d end"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := func(Node) bool { return true }
+	want := "Block IfStmt BinOpExpr NameExpr NumberExpr Block FuncCallStmt FuncCallExpr NameExpr NameExpr TableExpr StringExpr NumberExpr " +
+		"NameExpr Block ReturnStmt Block LocalStmt UnOpExpr NameExpr"
+	if got := walkOrder(b, all); got != want {
+		t.Errorf("got %s", got)
+	}
+
+	// 返回false时跳过子节点
+	skipIf := func(n Node) bool {
+		_, ok := n.(*IfStmt)
+		return !ok
+	}
+	if got := walkOrder(b, skipIf); got != "Block IfStmt" {
+		t.Errorf("got %s", got)
+	}
+
+	b, err = ParseChunk(lex("for i = 1, n do while x do repeat y = 1 until z end end"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "Block ForNumStmt NumberExpr NameExpr Block WhileStmt NameExpr Block RepeatStmt Block AssignStmt NameExpr NumberExpr NameExpr"
+	if got := walkOrder(b, all); got != want {
+		t.Errorf("got %s", got)
+	}
+}